@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var ArchivePrefix = "_archive/" //removed entities are kept at _archive/<kind>/<name>/<tx id> instead of being lost
+
+type Archived struct {
+	Kind      string          `json:"kind"`      // farm user policy
+	Name      string          `json:"name"`      // key or ID the entity had while live
+	Entity    json.RawMessage `json:"entity"`    // the entity as it was when removed
+	By        string          `json:"by"`        // user who removed it
+	Reason    string          `json:"reason"`    // why it was removed
+	TxID      string          `json:"tx_id"`     // transaction that removed it
+	Timestamp int64           `json:"timestamp"` // ms since epoch
+}
+
+// archive stores a copy of a removed entity under the archive namespace, the caller deletes the live key
+func archive(stub shim.ChaincodeStubInterface, kind string, name string, entity []byte, by string, reason string) error {
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	record := Archived{Kind: kind, Name: name, Entity: json.RawMessage(entity), By: by, Reason: reason, TxID: stub.GetTxID(), Timestamp: now}
+	recordAsBytes, _ := json.Marshal(record)
+	return stub.PutState(ArchivePrefix+kind+"/"+name+"/"+record.TxID, recordAsBytes)
+}
+
+// archiveWeather moves every reading of a farm under the archive namespace, at _archive/weather/<farm>/<tx id>/<date>/<source>,
+// so a farm created later under the same name starts without a history
+func archiveWeather(stub shim.ChaincodeStubInterface, farm string) error {
+	prefix := WeatherPrefix + farm + "/"
+	iter, err := stub.RangeQueryState(prefix, prefix+KeyMax)
+	if err != nil {
+		return errors.New("Failed to range over " + prefix)
+	}
+	var keys []string
+	var readings [][]byte
+	for iter.HasNext() {
+		key, readingAsBytes, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		keys = append(keys, key)
+		readings = append(readings, readingAsBytes)
+	}
+	iter.Close()
+
+	for i, key := range keys {
+		err = stub.PutState(ArchivePrefix+"weather/"+farm+"/"+stub.GetTxID()+"/"+strings.TrimPrefix(key, prefix), readings[i])
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Archive Farm - remove a farm with no active policies, farm owner or admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) archive_farm(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1
+	//  'farm_name'  'reason'
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	fmt.Println("- start archive farm")
+	farm, err := getFarm(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := isAdmin(stub, caller)
+	if err != nil {
+		return nil, err
+	}
+	if farm.Owner != caller && !admin {
+		return nil, errors.New("Only the owner of " + farm.Name + " or an admin can archive it")
+	}
+
+	err = requireUninsured(stub, farm.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if farm.Zone != "" {
+		zone, err := getZone(stub, farm.Zone)
+		if err != nil {
+			return nil, err
+		}
+		var kept []string
+		for _, name := range zone.Farms {
+			if name != farm.Name {
+				kept = append(kept, name)
+			}
+		}
+		zone.Farms = kept
+		err = putZone(stub, zone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, link := range farm.Stations {
+		err = unlinkStation(stub, link.Station, farm.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	farmAsBytes, _ := json.Marshal(farm)
+	err = archive(stub, "farm", farm.Name, farmAsBytes, caller, args[1])
+	if err != nil {
+		return nil, err
+	}
+	err = archiveWeather(stub, farm.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(farm.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = recordVersion(stub, "farm", farm.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = delIndex(stub, FarmIndexPrefix, farm.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end archive farm")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Close User - remove a user who benefits from no active policy, has no coin in escrow and manages no pool, the user or an admin only.
+// Coin left on the account has to be swept to another user.
+// ============================================================================================================================
+func (t *SimpleChaincode) close_user(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1               2
+	//  'name'  'sweep target'  'reason'     sweep target may be "" when the user holds no coin
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start close user")
+	name := strings.ToLower(args[0])
+	user, err := getUser(stub, name)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := isAdmin(stub, caller)
+	if err != nil {
+		return nil, err
+	}
+	if caller != name && !admin {
+		return nil, errors.New("Only " + name + " or an admin can close this user")
+	}
+
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, val := range Insurances.AllInsurance {
+		if val.Beneficiaries == name && val.live() {
+			return nil, errors.New("User is the beneficiary of an active insurance: " + val.ID)
+		}
+	}
+	escrow, err := heldEscrowOf(stub, name) //settling it later would fail on the missing user and strand the coin
+	if err != nil {
+		return nil, err
+	}
+	if escrow != "" {
+		return nil, errors.New("User has coin held in escrow: " + escrow)
+	}
+	pool, err := managedPoolOf(stub, name)
+	if err != nil {
+		return nil, err
+	}
+	if pool != "" {
+		return nil, errors.New("User still manages pool " + pool)
+	}
+
+	if user.Coin != 0 {
+		target := strings.ToLower(args[1])
+		if target == "" {
+			return nil, errors.New("User still holds coin, a sweep target is required")
+		}
+		if target == name {
+			return nil, errors.New("Cannot sweep a user's coin to itself")
+		}
+		err = move(stub, name, target, user.Coin, ReasonSweep, "")
+		if err != nil {
+			return nil, err
+		}
+		user.Coin = 0
+	}
+
+	userAsBytes, _ := json.Marshal(user)
+	err = archive(stub, "user", name, userAsBytes, caller, args[2])
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(name)
+	if err != nil {
+		return nil, err
+	}
+	err = recordVersion(stub, "user", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = delIndex(stub, UserIndexPrefix, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end close user")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Void Insurance - cancel a policy with no claims waiting on assessment and refund an escrowed premium, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) void_insurance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0         1
+	//  'policy'  'reason'
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	fmt.Println("- start void insurance")
+	caller, err := requireRole(stub, AdminRole)
+	if err != nil {
+		return nil, err
+	}
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	i := findInsurance(Insurances, args[0])
+	if i < 0 {
+		return nil, errors.New("insurance not exist")
+	}
+	policy := Insurances.AllInsurance[i]
+	if policy.State == "pending" {
+		return nil, errors.New("Insurance has a payout waiting on its challenge period")
+	}
+
+	iter, err := stub.RangeQueryState(claimKey(policy.ID, ""), claimKey(policy.ID, "~"))
+	if err != nil {
+		return nil, errors.New("Failed to range over claims of " + policy.ID)
+	}
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		var claim Claim
+		json.Unmarshal(valAsbytes, &claim)
+		if claim.State == "filed" {
+			iter.Close()
+			return nil, errors.New("Insurance has a claim waiting on assessment: " + claim.ID)
+		}
+	}
+	iter.Close()
+
+	if policy.PremiumEscrow != "" {
+		escrow, err := getEscrow(stub, policy.PremiumEscrow)
+		if err != nil {
+			return nil, err
+		}
+		if escrow.State == "held" {
+			err = settleEscrow(stub, &escrow, false, caller)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	policy.State = "voided"
+	policyAsBytes, _ := json.Marshal(policy)
+	err = archive(stub, "policy", policy.ID, policyAsBytes, caller, args[1])
+	if err != nil {
+		return nil, err
+	}
+	Insurances.AllInsurance = append(Insurances.AllInsurance[:i], Insurances.AllInsurance[i+1:]...)
+	err = putInsurances(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(ListingPrefix + policy.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end void insurance")
+	return nil, nil
+}
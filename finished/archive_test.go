@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCloseUser(t *testing.T) {
+	cases := []struct {
+		name    string
+		setup   func(t *testing.T, stub *fakeStub)
+		wantErr string
+	}{
+		{name: "nothing held", setup: func(t *testing.T, stub *fakeStub) {}},
+		{name: "holder of an escrow", setup: func(t *testing.T, stub *fakeStub) {
+			if _, err := openEscrow(stub, "ben", InsurerAccount, 10, ReasonPremium, "p1", EscrowConditions{}); err != nil {
+				t.Fatal(err)
+			}
+		}, wantErr: "escrow"},
+		{name: "beneficiary of an escrow", setup: func(t *testing.T, stub *fakeStub) {
+			if err := putAccount(stub, Account{Name: InsurerAccount, Balance: 10}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := openEscrow(stub, InsurerAccount, "ben", 10, ReasonPayout, "p1", EscrowConditions{Managed: true}); err != nil {
+				t.Fatal(err)
+			}
+		}, wantErr: "escrow"},
+		{name: "settled escrow", setup: func(t *testing.T, stub *fakeStub) {
+			escrow, err := openEscrow(stub, "ben", InsurerAccount, 10, ReasonPremium, "p1", EscrowConditions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = settleEscrow(stub, &escrow, false, ""); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "pool manager", setup: func(t *testing.T, stub *fakeStub) {
+			if err := putPool(stub, Pool{Name: "pool1", Manager: "ben"}); err != nil {
+				t.Fatal(err)
+			}
+		}, wantErr: "manages pool pool1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := newFakeStub(testNow)
+			if err := putUser(stub, User{Name: "ben", Coin: 10}); err != nil {
+				t.Fatal(err)
+			}
+			if err := putUser(stub, User{Name: "carol"}); err != nil {
+				t.Fatal(err)
+			}
+			c.setup(t, stub)
+			stub.caller = "ben"
+			_, err := new(SimpleChaincode).Invoke(stub, "close_user", []string{"ben", "carol", "leaving"})
+			if c.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stub.state["ben"] != nil {
+					t.Fatal("ben was not closed")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var CoveragePrefix = "_coverage/" //every coverage request lives at _coverage/<id>
+var BidPrefix = "_bid/"           //every sealed bid lives at _bid/<request>/<pool> so a request's bids range-read together
+
+var ReasonPremium = "premium" //a policy's premium paid to its insurer
+
+type CoverageRequest struct { //a farm owner asking insurer pools to bid on cover
+	ID             string `json:"id"`              // transaction ID of post_coverage_request
+	Farm           string `json:"farm"`            // farm to insure
+	Owner          string `json:"owner"`           // farm owner who asked, pays the premium and is the beneficiary
+	Trigger        int    `json:"trigger"`         // adverse days in a row that pay out
+	SumInsured     int    `json:"sum_insured"`     // cover wanted, becomes Number 1 at Rate SumInsured
+	TermDays       int    `json:"term_days"`       // days of cover from the award
+	CommitDeadline int64  `json:"commit_deadline"` // ms since epoch, sealed bids are taken until then
+	RevealDeadline int64  `json:"reveal_deadline"` // ms since epoch, bids are revealed between the two deadlines
+	State          string `json:"state"`           // open awarded failed
+	Winner         string `json:"winner"`          // pool that won, "" until awarded
+	Policy         string `json:"policy"`          // ID of the policy the award created
+}
+
+type Bid struct {
+	Request    string `json:"request"`    // coverage request bid on
+	Pool       string `json:"pool"`       // bidding pool
+	Commitment string `json:"commitment"` // hex sha256 of bidCommitment, set when committed
+	Premium    int    `json:"premium"`    // coin asked, 0 until revealed
+	Revealed   bool   `json:"revealed"`   // the revealed premium and salt matched the commitment
+}
+
+type CoverageBook struct {
+	Request CoverageRequest `json:"request"`
+	Bids    []Bid           `json:"bids"` // by pool name
+}
+
+// bidCommitment is what a pool hashes when it commits, the request and pool are included so a commitment cannot be
+// copied onto another request or by another pool
+func bidCommitment(request string, pool string, premium int, salt string) string {
+	sum := sha256.Sum256([]byte(request + "|" + pool + "|" + strconv.Itoa(premium) + "|" + salt))
+	return hex.EncodeToString(sum[:])
+}
+
+func bidKey(request string, pool string) string {
+	return BidPrefix + request + "/" + pool
+}
+
+func getCoverageRequest(stub shim.ChaincodeStubInterface, id string) (CoverageRequest, error) {
+	var request CoverageRequest
+	requestAsBytes, err := stub.GetState(CoveragePrefix + id)
+	if err != nil {
+		return request, errors.New("Failed to get coverage request " + id)
+	}
+	json.Unmarshal(requestAsBytes, &request)
+	if request.ID != id {
+		return request, errors.New("coverage request not exist")
+	}
+	return request, nil
+}
+
+func putCoverageRequest(stub shim.ChaincodeStubInterface, request CoverageRequest) error {
+	requestAsBytes, _ := json.Marshal(request)
+	return stub.PutState(CoveragePrefix+request.ID, requestAsBytes)
+}
+
+func getBids(stub shim.ChaincodeStubInterface, request string) ([]Bid, error) {
+	iter, err := stub.RangeQueryState(bidKey(request, ""), bidKey(request, KeyMax))
+	if err != nil {
+		return nil, errors.New("Failed to range over bids on " + request)
+	}
+	defer iter.Close()
+
+	bids := []Bid{}
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var bid Bid
+		json.Unmarshal(valAsbytes, &bid)
+		bids = append(bids, bid)
+	}
+	return bids, nil
+}
+
+// managedPool returns the pool if the caller manages it
+func managedPool(stub shim.ChaincodeStubInterface, name string) (Pool, error) {
+	pool, err := getPool(stub, strings.ToLower(name))
+	if err != nil {
+		return pool, err
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return pool, err
+	}
+	if caller != pool.Manager {
+		return pool, errors.New("Only the manager of " + pool.Name + " can act for it")
+	}
+	return pool, nil
+}
+
+// ============================================================================================================================
+// Post Coverage Request - a farm owner asks pools for sealed premium bids on cover for the farm
+// ============================================================================================================================
+func (t *SimpleChaincode) post_coverage_request(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1          2              3            4               5
+	//  'farm'  'trigger'  'sum insured'  'term days'  'commit hours'  'reveal hours'     reveal hours run from the commit deadline
+	if len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+	}
+
+	fmt.Println("- start post coverage request")
+	farm, err := ownedFarm(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	var values [5]int
+	for i := range values {
+		value, err := strconv.Atoi(args[i+1])
+		if err != nil || value <= 0 {
+			return nil, errors.New("Argument " + strconv.Itoa(i+2) + " must be a positive numeric string")
+		}
+		values[i] = value
+	}
+	if values[0] > WeatherWindow {
+		return nil, errors.New("2nd argument must be a number of days between 1 and " + strconv.Itoa(WeatherWindow))
+	}
+
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	hour := int64(60 * 60 * 1000)
+	request := CoverageRequest{ID: stub.GetTxID(), Farm: farm.Name, Owner: farm.Owner, Trigger: values[0], SumInsured: values[1], TermDays: values[2], State: "open"}
+	request.CommitDeadline = now + int64(values[3])*hour
+	request.RevealDeadline = request.CommitDeadline + int64(values[4])*hour
+	err = putCoverageRequest(stub, request)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end post coverage request")
+	return []byte(request.ID), nil
+}
+
+// ============================================================================================================================
+// Commit Bid - a pool's manager seals a premium bid as a hash before the commit deadline, committing again replaces it
+// ============================================================================================================================
+func (t *SimpleChaincode) commit_bid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0          1       2
+	//  'request'  'pool'  'commitment'     hex sha256 of "<request>|<pool>|<premium>|<salt>"
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start commit bid")
+	request, err := getCoverageRequest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	if request.State != "open" || now >= request.CommitDeadline {
+		return nil, errors.New("Bids on " + request.ID + " are closed")
+	}
+	pool, err := managedPool(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	commitment := strings.ToLower(args[2])
+	if decoded, err := hex.DecodeString(commitment); err != nil || len(decoded) != sha256.Size {
+		return nil, errors.New("3rd argument must be a hex sha256 hash")
+	}
+
+	bid := Bid{Request: request.ID, Pool: pool.Name, Commitment: commitment}
+	bidAsBytes, _ := json.Marshal(bid)
+	err = stub.PutState(bidKey(request.ID, pool.Name), bidAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end commit bid")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Reveal Bid - open a committed bid between the commit and reveal deadlines
+// ============================================================================================================================
+func (t *SimpleChaincode) reveal_bid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0          1       2          3
+	//  'request'  'pool'  'premium'  'salt'
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	fmt.Println("- start reveal bid")
+	request, err := getCoverageRequest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	if request.State != "open" || now < request.CommitDeadline || now >= request.RevealDeadline {
+		return nil, errors.New("Bids on " + request.ID + " can only be revealed between the commit and reveal deadlines")
+	}
+	pool, err := managedPool(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	var bid Bid
+	bidAsBytes, err := stub.GetState(bidKey(request.ID, pool.Name))
+	if err != nil {
+		return nil, errors.New("Failed to get bid of " + pool.Name)
+	}
+	json.Unmarshal(bidAsBytes, &bid)
+	if bid.Pool != pool.Name {
+		return nil, errors.New("bid not exist")
+	}
+	premium, err := strconv.Atoi(args[2])
+	if err != nil || premium <= 0 {
+		return nil, errors.New("3rd argument must be a positive numeric string")
+	}
+	if bidCommitment(request.ID, pool.Name, premium, args[3]) != bid.Commitment {
+		return nil, errors.New("Premium and salt do not match the commitment")
+	}
+
+	bid.Premium = premium
+	bid.Revealed = true
+	bidAsBytes, _ = json.Marshal(bid)
+	err = stub.PutState(bidKey(request.ID, pool.Name), bidAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end reveal bid")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Award Coverage - after the reveal deadline the requester pays the lowest valid bid and the policy becomes active
+// ============================================================================================================================
+func (t *SimpleChaincode) award_coverage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'request'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	fmt.Println("- start award coverage")
+	request, err := getCoverageRequest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if request.State != "open" {
+		return nil, errors.New("Coverage request has already been decided")
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now < request.RevealDeadline {
+		return nil, errors.New("Bids on " + request.ID + " are still being revealed")
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != request.Owner {
+		return nil, errors.New("Only " + request.Owner + " can award this coverage")
+	}
+	bids, err := getBids(stub, request.ID)
+	if err != nil {
+		return nil, err
+	}
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	//bids come back in pool name order, so equal premiums go to the first pool by name. A bid the pool can no longer
+	//carry under the exposure limits is passed over for the next lowest.
+	policy := AnInsurance{ID: stub.GetTxID(), Insurant: request.Farm, Beneficiaries: request.Owner, Timestamp: now, Number: 1, Rate: request.SumInsured, State: "actived", Trigger: request.Trigger}
+	policy.Expires = now + int64(request.TermDays)*24*60*60*1000
+	var winner *Bid
+	for i, bid := range bids {
+		if !bid.Revealed || (winner != nil && bid.Premium >= winner.Premium) {
+			continue
+		}
+		pool, err := getPool(stub, bid.Pool)
+		if err != nil {
+			return nil, err
+		}
+		policy.Pool = pool.Name
+		policy.Cessions = pool.Treaties
+		if checkExposure(stub, Insurances, policy) != nil {
+			continue
+		}
+		winner = &bids[i]
+	}
+
+	if winner == nil {
+		request.State = "failed"
+	} else {
+		pool, err := getPool(stub, winner.Pool)
+		if err != nil {
+			return nil, err
+		}
+		policy.Pool = pool.Name
+		policy.Cessions = pool.Treaties
+		policy.Premium = winner.Premium
+		policy.Buyer = request.Owner
+		//the premium is earned once the term is over, until then the pool's manager can hand it back
+		escrow, err := openEscrow(stub, request.Owner, poolAccount(pool.Name), policy.Premium, ReasonPremium, policy.ID, EscrowConditions{ReleaseAfter: policy.Expires, Refunders: []string{pool.Manager}})
+		if err != nil {
+			return nil, err
+		}
+		policy.PremiumEscrow = escrow.ID
+		Insurances.AllInsurance = append(Insurances.AllInsurance, policy)
+		err = putInsurances(stub, Insurances)
+		if err != nil {
+			return nil, err
+		}
+		request.State = "awarded"
+		request.Winner = pool.Name
+		request.Policy = policy.ID
+	}
+	err = putCoverageRequest(stub, request)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end award coverage")
+	return []byte(request.Policy), nil
+}
+
+// ============================================================================================================================
+// Get Coverage Request - read a coverage request and its bids, premiums stay hidden until revealed
+// ============================================================================================================================
+func (t *SimpleChaincode) get_coverage_request(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'request'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	request, err := getCoverageRequest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	bids, err := getBids(stub, request.ID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(CoverageBook{Request: request, Bids: bids})
+}
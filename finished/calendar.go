@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var CalendarPrefix = "_calendar/" //every crop calendar lives at _calendar/<crop>
+
+var CropStages = []string{"sowing", "vegetative", "flowering", "harvest"} //stages a calendar lists, in growing order
+
+type Stage struct {
+	Name string `json:"name"` // one of CropStages
+	Days int    `json:"days"` // how long the stage lasts
+}
+
+type CropCalendar struct {
+	Crop   string  `json:"crop"`   // crop type the calendar is for
+	Stages []Stage `json:"stages"` // in growing order, the first starts on the planting date
+}
+
+type StageWindow struct {
+	Name  string `json:"name"`  // stage name
+	Start string `json:"start"` // first day of the stage
+	End   string `json:"end"`   // first day after the stage
+}
+
+func getCalendar(stub shim.ChaincodeStubInterface, crop string) (CropCalendar, error) {
+	var calendar CropCalendar
+	calendarAsBytes, err := stub.GetState(CalendarPrefix + crop)
+	if err != nil {
+		return calendar, errors.New("Failed to get crop calendar " + crop)
+	}
+	json.Unmarshal(calendarAsBytes, &calendar)
+	if calendar.Crop != crop {
+		return calendar, errors.New("No crop calendar for " + crop)
+	}
+	return calendar, nil
+}
+
+// windows lays the calendar's stages out as dates starting from planted
+func (c CropCalendar) windows(planted string) ([]StageWindow, error) {
+	plantedMs, err := parseDate(planted)
+	if err != nil {
+		return nil, err
+	}
+	day := time.Unix(0, plantedMs*int64(time.Millisecond)).UTC()
+	var windows []StageWindow
+	for _, stage := range c.Stages {
+		end := day.AddDate(0, 0, stage.Days)
+		windows = append(windows, StageWindow{Name: stage.Name, Start: day.Format(DateLayout), End: end.Format(DateLayout)})
+		day = end
+	}
+	return windows, nil
+}
+
+// stageWindow finds when a plot's crop is in stage, using the calendar of the plot's crop
+func stageWindow(stub shim.ChaincodeStubInterface, plot Plot, stage string) (StageWindow, error) {
+	calendar, err := getCalendar(stub, plot.Crop)
+	if err != nil {
+		return StageWindow{}, err
+	}
+	windows, err := calendar.windows(plot.Planted)
+	if err != nil {
+		return StageWindow{}, err
+	}
+	for _, window := range windows {
+		if window.Name == stage {
+			return window, nil
+		}
+	}
+	return StageWindow{}, errors.New(plot.Crop + " has no " + stage + " stage")
+}
+
+// inStage reports whether the transaction date and the last trigger days of the farm's weather all fall in the
+// stage the policy names for its plot. Policies without a stage are always in stage. The window written on the
+// policy is used, only policies from before windows were kept look the stage up in the current calendar.
+func inStage(stub shim.ChaincodeStubInterface, farm Farm, insurance AnInsurance, trigger int) (bool, error) {
+	if insurance.Stage == "" {
+		return true, nil
+	}
+	i := findPlot(farm, insurance.Plot)
+	if i < 0 || trigger > len(farm.Summary.Recent) {
+		return false, nil
+	}
+	window := insurance.StageWindow
+	if window.Start == "" {
+		var err error
+		window, err = stageWindow(stub, farm.Plots[i], insurance.Stage)
+		if err != nil {
+			return false, err
+		}
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return false, err
+	}
+	today := time.Unix(0, now*int64(time.Millisecond)).UTC().Format(DateLayout)
+	recent := farm.Summary.Recent
+	first := recent[len(recent)-trigger].Date
+	return window.Start <= today && today < window.End && window.Start <= first, nil
+}
+
+// ============================================================================================================================
+// Set Crop Calendar - store the growth stages of a crop type, admin only. Policies already written keep their stage dates.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_crop_calendar(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1              2 ...
+	//  'crop'  'stage:days'   'stage:days' ...       e.g. lettuce sowing:7 vegetative:30 flowering:14 harvest:10
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting >=2")
+	}
+
+	fmt.Println("- start set crop calendar")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	calendar := CropCalendar{Crop: strings.ToLower(args[0])}
+	next := 0
+	for _, arg := range args[1:] {
+		parts := strings.Split(arg, ":")
+		if len(parts) != 2 {
+			return nil, errors.New("Stages must look like stage:days, got " + arg)
+		}
+		stage := Stage{Name: strings.ToLower(parts[0])}
+		for next < len(CropStages) && CropStages[next] != stage.Name {
+			next++
+		}
+		if next >= len(CropStages) {
+			return nil, errors.New("Stages must be some of " + strings.Join(CropStages, ", ") + " in that order")
+		}
+		next++
+		days, err := strconv.Atoi(parts[1])
+		if err != nil || days <= 0 {
+			return nil, errors.New("Stage days must be a positive number, got " + arg)
+		}
+		stage.Days = days
+		calendar.Stages = append(calendar.Stages, stage)
+	}
+
+	jsonAsBytes, _ := json.Marshal(calendar)
+	err := stub.PutState(CalendarPrefix+calendar.Crop, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end set crop calendar")
+	return nil, nil
+}
@@ -15,20 +15,32 @@ import (
 type SimpleChaincode struct {
 }
 
-var FarmWeatherIndexStr = "_farmindex"    //name for the key/value that will store a list of all known marbles
+var FarmIndexPrefix = "_farmindex/"       //every known farm has a key _farmindex/<name>, range over them to list farms
 var ActiveInsuranceStr = "_openinsurance" //name for the key/value that will store all open trades
-var UserIndexStr = "_userindex"
+var UserIndexPrefix = "_userindex/"       //every known user has a key _userindex/<name>
 
 type Weather struct {
-	Name        string `json:"name"`        // rainy sunny cloudy
+	Name        string `json:"name"`        // rainy sunny cloudy, normalized against the ledger vocabulary
+	Severity    string `json:"severity"`    // adverse neutral favourable, as the vocabulary classed Name when stored
 	Temperature int    `json:"temperature"` // -274 C - max int
+	Farm        string `json:"farm"`        // farm the reading was taken for
+	Date        string `json:"date"`        // day the reading was observed, YYYY-MM-DD
+	Source      string `json:"source"`      // who reported it, one reading per farm, date and source
+	Observed    int64  `json:"observed"`    // start of Date, ms since epoch
+	Recorded    int64  `json:"recorded"`    // when the reading reached the ledger, ms since epoch
 }
 
 type Farm struct {
-	Name         string    `json:"name"` //the fieldtags are needed to keep case from bouncing around
-	Address      string    `json:"address"`
-	Owner        string    `json:"owner"`
-	WeatherIndex []Weather `json:"weather_index"`
+	Name         string         `json:"name"` //the fieldtags are needed to keep case from bouncing around
+	Address      string         `json:"address"`
+	Owner        string         `json:"owner"`
+	Latitude     float64        `json:"latitude"`        // decimal degrees, north positive
+	Longitude    float64        `json:"longitude"`       // decimal degrees, east positive
+	Zone         string         `json:"zone"`            // weather zone the farm is in, "" until it is located
+	Plots        []Plot         `json:"plots"`           // beds and the crops growing in them
+	OwnerHistory []OwnerChange  `json:"owner_history"`   // previous owners, oldest first
+	Stations     []StationLink  `json:"stations"`        // weather stations whose readings the farm takes
+	Summary      WeatherSummary `json:"weather_summary"` // rolling view of the readings stored under WeatherPrefix
 }
 
 type User struct {
@@ -37,12 +49,32 @@ type User struct {
 }
 
 type AnInsurance struct { //when bad things happen the beneficiaries get coin = Number * Rate
-	Insurant      string `json:"insurant"`      // who is the target we will protect farm name
-	Beneficiaries string `json:"beneficiaries"` // who will beneficial from this insurance user name
-	Timestamp     int64  `json:"timestamp"`     // when this insurance entry into force
-	Number        int    `json:"number"`        // Number of insured
-	Rate          int    `json:"rate"`          // decide how many coins beneficiaries will get.
-	State         string `json:"state"`         // wait active end
+	ID             string      `json:"id"`              // transaction ID of create_insurance
+	Insurant       string      `json:"insurant"`        // who is the target we will protect farm name
+	Beneficiaries  string      `json:"beneficiaries"`   // who will beneficial from this insurance user name
+	Timestamp      int64       `json:"timestamp"`       // when this insurance entry into force
+	Number         int         `json:"number"`          // Number of insured
+	Rate           int         `json:"rate"`            // decide how many coins beneficiaries will get.
+	State          string      `json:"state"`           // wait active end
+	Paid           int         `json:"paid"`            // coin paid out so far, never more than Number * Rate
+	Trigger        int         `json:"trigger"`         // adverse days in a row that pay out, AdverseStreakTrigger when 0
+	Premium        int         `json:"premium"`         // coin quoted for the cover, 0 when created without a quote
+	QuoteAsOf      string      `json:"quote_as_of"`     // as-of date of the quote the premium was checked against
+	Plot           string      `json:"plot"`            // plot of the insured farm the policy covers, "" for the whole farm
+	Stage          string      `json:"stage"`           // growth stage of the plot's crop the trigger only counts in, "" for any
+	StageWindow    StageWindow `json:"stage_window"`    // dates of Stage when the policy was written, later calendar changes do not move them
+	Pool           string      `json:"pool"`            // insurer pool that underwrote the policy, "" for InsurerAccount
+	Cessions       []Treaty    `json:"cessions"`        // the pool's treaties when the policy was written, reinsurers pay these shares
+	Expires        int64       `json:"expires"`         // ms since epoch, weather after it no longer pays out, 0 for never
+	PremiumEscrow  string      `json:"premium_escrow"`  // escrow holding the premium until the pool has earned it, "" if not escrowed
+	Rule           string      `json:"rule"`            // trigger rule text, "" pays on Trigger adverse days in a row
+	Schedule       []int       `json:"schedule"`        // share of the cover paid each time the rule fires in basis points, the last repeats, all of it when empty
+	Installments   int         `json:"installments"`    // payouts started so far, picks the next share of Schedule
+	Product        string      `json:"product"`         // product the policy was written on, "" when specified ad hoc
+	ProductVersion int         `json:"product_version"` // version of the product it was written on
+	UpheldThrough  string      `json:"upheld_through"`  // last day of a payout a challenge was upheld against, the trigger only sees later days
+	FiredThrough   string      `json:"fired_through"`   // last day of weather the trigger fired on, each day pays at most one installment
+	Buyer          string      `json:"buyer"`           // user who pays the premium, the beneficiary or the farm's owner
 }
 
 type ActiveInsurance struct {
@@ -60,14 +92,16 @@ func main() {
 }
 
 // ============================================================================================================================
-// Init - reset all the things
+// Init - set up all the things, once. Coin that already exists is never reset.
 // ============================================================================================================================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	var Aval int
 	var err error
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	//   0       1          2
+	//  'abc'   ['admin'   ['insurer capital']]     admin defaults to the deploying user, capital is minted into InsurerAccount
+	if len(args) != 1 && len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1, 2 or 3")
 	}
 
 	// Initialize the chaincode
@@ -75,6 +109,15 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 	if err != nil {
 		return nil, errors.New("Expecting integer value for asset holding")
 	}
+	for _, key := range []string{SupplyStr, AccountPrefix + IssuanceAccount, AccountPrefix + FaucetAccount, AccountPrefix + InsurerAccount, AccountPrefix + EscrowAccount} {
+		existing, err := stub.GetState(key)
+		if err != nil {
+			return nil, errors.New("Failed to get " + key)
+		}
+		if existing != nil { //users keep their coin, so the supply and the system accounts must keep theirs
+			return nil, errors.New("Coin supply is already set up, " + key + " cannot be reset")
+		}
+	}
 
 	// Write the state to the ledger
 	err = stub.PutState("abc", []byte(strconv.Itoa(Aval))) //making a test var "abc", I find it handy to read/write to it right away to test the network
@@ -82,21 +125,73 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 		return nil, err
 	}
 
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty) //marshal an emtpy array of strings to clear the index
-	err = stub.PutState(FarmWeatherIndexStr, jsonAsBytes)
+	var insurances ActiveInsurance
+	jsonAsBytes, _ := json.Marshal(insurances) //clear the open trade struct
+	err = stub.PutState(ActiveInsuranceStr, jsonAsBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	err = stub.PutState(UserIndexStr, jsonAsBytes)
+	jsonAsBytes, _ = json.Marshal(defaultVocabulary()) //reset the weather conditions
+	err = stub.PutState(ConditionsStr, jsonAsBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	var insurances ActiveInsurance
-	jsonAsBytes, _ = json.Marshal(insurances) //clear the open trade struct
-	err = stub.PutState(ActiveInsuranceStr, jsonAsBytes)
+	var admin string
+	if len(args) >= 2 && len(args[1]) > 0 {
+		admin = strings.ToLower(args[1])
+	} else if admin, err = callerName(stub); err != nil {
+		return nil, errors.New("Expecting an admin name when the deployer has no " + UsernameAttr + " attribute")
+	}
+	jsonAsBytes, _ = json.Marshal(defaultPricing()) //reset the premium pricing factors
+	err = stub.PutState(PricingStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ = json.Marshal(defaultLimits()) //reset the solvency and concentration limits
+	err = stub.PutState(LimitsStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ = json.Marshal(defaultDisputeSettings()) //reset the payout challenge period
+	err = stub.PutState(DisputeStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ = json.Marshal(Supply{}) //start the coin supply and the system accounts that hold it
+	err = stub.PutState(SupplyStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{IssuanceAccount, FaucetAccount, InsurerAccount, EscrowAccount} {
+		err = putAccount(stub, Account{Name: name})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(args) == 3 { //without capital the insurer can write no cover of its own until an admin mints into it
+		capital, err := strconv.Atoi(args[2])
+		if err != nil || capital < 0 {
+			return nil, errors.New("3rd argument must be a non-negative numeric string")
+		}
+		err = move(stub, IssuanceAccount, InsurerAccount, capital, ReasonMint+": insurer capital", "")
+		if err != nil {
+			return nil, err
+		}
+		jsonAsBytes, _ = json.Marshal(Supply{Total: capital, Minted: capital})
+		err = stub.PutState(SupplyStr, jsonAsBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	roles := Roles{Members: map[string][]string{AdminRole: {admin}}}
+	jsonAsBytes, _ = json.Marshal(roles) //reset who holds which role
+	err = stub.PutState(RolesStr, jsonAsBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -119,9 +214,7 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 	fmt.Println("invoke is running " + function)
 
 	// Handle different functions
-	if function == "init" { //initialize the chaincode state, used as reset
-		return t.Init(stub, "init", args)
-	} else if function == "write" { //writes a value to the chaincode state
+	if function == "write" { //writes a value to the chaincode state
 		return t.Write(stub, args)
 	} else if function == "create_user" { //create a new marble
 		return t.create_user(stub, args)
@@ -129,10 +222,94 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.create_farm(stub, args)
 	} else if function == "create_insurance" { //forfill an open trade order
 		return t.create_insurance(stub, args)
-		fmt.Println("create_insurance")
 	} else if function == "update_weather" { //cancel an open trade order
 		return t.update_weather(stub, args)
-		fmt.Println("update weather")
+	} else if function == "set_condition" { //add or change a weather condition in the vocabulary
+		return t.set_condition(stub, args)
+	} else if function == "register_role" { //grant or revoke a role such as assessor
+		return t.register_role(stub, args)
+	} else if function == "file_claim" { //claim for a loss against a policy
+		return t.file_claim(stub, args)
+	} else if function == "assess_claim" { //decide and pay a filed claim
+		return t.assess_claim(stub, args)
+	} else if function == "set_farm_location" { //place a farm at a coordinate and in a weather zone
+		return t.set_farm_location(stub, args)
+	} else if function == "update_weather_zone" { //record weather for every farm in a zone at once
+		return t.update_weather_zone(stub, args)
+	} else if function == "set_pricing" { //change the premium pricing factors
+		return t.set_pricing(stub, args)
+	} else if function == "add_plot" { //add a crop plot to a farm
+		return t.add_plot(stub, args)
+	} else if function == "harvest_plot" { //record a plot's harvest
+		return t.harvest_plot(stub, args)
+	} else if function == "set_crop_calendar" { //store the growth stages of a crop type
+		return t.set_crop_calendar(stub, args)
+	} else if function == "archive_farm" { //remove a farm into the archive
+		return t.archive_farm(stub, args)
+	} else if function == "close_user" { //remove a user into the archive
+		return t.close_user(stub, args)
+	} else if function == "void_insurance" { //cancel a policy into the archive
+		return t.void_insurance(stub, args)
+	} else if function == "update_farm" { //change a farm's address
+		return t.update_farm(stub, args)
+	} else if function == "transfer_farm" { //hand a farm to a new owner
+		return t.transfer_farm(stub, args)
+	} else if function == "mint" { //create coin, admin only
+		return t.mint(stub, args)
+	} else if function == "burn" { //destroy coin
+		return t.burn(stub, args)
+	} else if function == "create_pool" { //open an insurer pool
+		return t.create_pool(stub, args)
+	} else if function == "fund_pool" { //pay capital into a pool
+		return t.fund_pool(stub, args)
+	} else if function == "set_treaty" { //cede a share of a pool to a reinsurer
+		return t.set_treaty(stub, args)
+	} else if function == "set_limits" { //change the solvency and concentration limits
+		return t.set_limits(stub, args)
+	} else if function == "list_policy_for_sale" { //offer a policy's payout rights
+		return t.list_policy_for_sale(stub, args)
+	} else if function == "buy_policy" { //pay the seller and become beneficiary
+		return t.buy_policy(stub, args)
+	} else if function == "delist" { //take a policy off the market
+		return t.delist(stub, args)
+	} else if function == "post_coverage_request" { //ask pools to bid on cover
+		return t.post_coverage_request(stub, args)
+	} else if function == "commit_bid" { //seal a premium bid
+		return t.commit_bid(stub, args)
+	} else if function == "reveal_bid" { //open a sealed bid
+		return t.reveal_bid(stub, args)
+	} else if function == "award_coverage" { //pay the lowest bid and activate the policy
+		return t.award_coverage(stub, args)
+	} else if function == "release_escrow" { //pay an escrow to its beneficiary
+		return t.release_escrow(stub, args)
+	} else if function == "refund_escrow" { //give an escrow back to its holder
+		return t.refund_escrow(stub, args)
+	} else if function == "challenge_payout" { //dispute a held weather payout
+		return t.challenge_payout(stub, args)
+	} else if function == "resolve_challenge" { //uphold or dismiss a challenged payout
+		return t.resolve_challenge(stub, args)
+	} else if function == "finalize_payouts" { //pay unchallenged payouts that are due
+		return t.finalize_payouts(stub, args)
+	} else if function == "set_challenge_period" { //change how long payouts are held
+		return t.set_challenge_period(stub, args)
+	} else if function == "register_station" { //record a station and its signing key
+		return t.register_station(stub, args)
+	} else if function == "update_station" { //calibrate or decommission a station
+		return t.update_station(stub, args)
+	} else if function == "link_station" { //take a station's readings for a farm
+		return t.link_station(stub, args)
+	} else if function == "unlink_station" { //stop taking a station's readings
+		return t.unlink_station(stub, args)
+	} else if function == "update_weather_station" { //record a station observation for its farms
+		return t.update_weather_station(stub, args)
+	} else if function == "define_product" { //add a product or a new version of one
+		return t.define_product(stub, args)
+	} else if function == "fund_payout" { //start an unfunded payout once it can be covered
+		return t.fund_payout(stub, args)
+	} else if function == "accept_insurance" { //take on a policy proposed to a pool
+		return t.accept_insurance(stub, args)
+	} else if function == "define_zone" { //add a named weather region, admin only
+		return t.define_zone(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function) //error
 
@@ -148,6 +325,38 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 	// Handle different functions
 	if function == "read" { //read a variable
 		return t.read(stub, args)
+	} else if function == "get_weather" { //read a farm's weather readings between two dates
+		return t.get_weather(stub, args)
+	} else if function == "get_claims" { //read the claims filed against a policy
+		return t.get_claims(stub, args)
+	} else if function == "quote_insurance" { //price a policy from stored weather
+		return t.quote_insurance(stub, args)
+	} else if function == "list_users" { //page through known users
+		return t.list_users(stub, args)
+	} else if function == "list_farms" { //page through known farms
+		return t.list_farms(stub, args)
+	} else if function == "get_history" { //read every version of a user, farm or policy
+		return t.get_history(stub, args)
+	} else if function == "get_statement" { //read an account's journal between two dates
+		return t.get_statement(stub, args)
+	} else if function == "verify_books" { //check balances against the journal
+		return t.verify_books(stub, args)
+	} else if function == "verify_supply" { //check users and system accounts add up to the supply
+		return t.verify_supply(stub, args)
+	} else if function == "get_exposure" { //open cover by pool, zone and farm
+		return t.get_exposure(stub, args)
+	} else if function == "get_order_book" { //policies on offer, cheapest first
+		return t.get_order_book(stub, args)
+	} else if function == "get_coverage_request" { //a coverage request and its bids
+		return t.get_coverage_request(stub, args)
+	} else if function == "get_escrow" { //an escrow and its conditions
+		return t.get_escrow(stub, args)
+	} else if function == "get_payout" { //a held payout and its challenge
+		return t.get_payout(stub, args)
+	} else if function == "validate_rule" { //parse and type check trigger rule text
+		return t.validate_rule(stub, args)
+	} else if function == "get_product" { //a product, current or an older version
+		return t.get_product(stub, args)
 	}
 	fmt.Println("query did not find func: " + function) //error
 
@@ -176,7 +385,7 @@ func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string)
 }
 
 // ============================================================================================================================
-// Write - write variable into chaincode state
+// Write - write variable into chaincode state, admin only since it can overwrite roles, balances and policies
 // ============================================================================================================================
 func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var name, value string // Entities
@@ -186,6 +395,9 @@ func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string)
 	if len(args) != 2 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
 	}
+	if _, err = requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
 
 	name = args[0] //rename for funsies
 	value = args[1]
@@ -203,25 +415,31 @@ func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string)
 func (t *SimpleChaincode) create_user(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 
-	//   0       1       2     3
-	//  'name'   'money'
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	//   0       1
+	//  'name'  ['money']     money is taken from the faucet, a user created without it starts at zero
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 or 2")
 	}
 
 	//input sanitation
 	fmt.Println("- start create user")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+	if len(args[0]) <= 0 || strings.Contains(args[0], "/") {
+		return nil, errors.New("1st argument must be a non-empty name without '/'")
 	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+	if len(args) == 1 {
+		args = append(args, "0")
 	}
 
 	name := strings.ToLower(args[0])
+	if isSystemAccount(name) {
+		return nil, errors.New("User names cannot start with @")
+	}
+	if reservedName(name) {
+		return nil, errors.New("User names cannot start with _")
+	}
 	coin, err := strconv.Atoi(args[1])
-	if err != nil {
-		return nil, errors.New("2rd argument must be a numeric string")
+	if err != nil || coin < 0 {
+		return nil, errors.New("2rd argument must be a non-negative numeric string")
 	}
 
 	//check if marble already exists
@@ -240,47 +458,74 @@ func (t *SimpleChaincode) create_user(stub shim.ChaincodeStubInterface, args []s
 	//build the user json string manually
 	var user User
 	user.Name = name
-	user.Coin = coin
-	UserAsBytes, err = json.Marshal(user)
-	err = stub.PutState(name, UserAsBytes) //store marble with id as key
+	err = putUser(stub, user) //store user with name as key
 	if err != nil {
 		return nil, err
 	}
-
-	//get the marble index
-	UsersAsBytes, err := stub.GetState(UserIndexStr)
+	err = move(stub, FaucetAccount, name, coin, ReasonOpening, "") //fund the starting coin from the faucet so supply never grows here
 	if err != nil {
-		return nil, errors.New("Failed to get marble index")
+		return nil, err
 	}
-	var UserIndex []string
-	json.Unmarshal(UsersAsBytes, &UserIndex) //un stringify it aka JSON.parse()
 
-	//append
-	UserIndex = append(UserIndex, name) //add marble name to index list
-	fmt.Println("! User index: ", UserIndex)
-	jsonAsBytes, _ := json.Marshal(UserIndex)
-	err = stub.PutState(UserIndexStr, jsonAsBytes) //store name of marble
+	//index the user under its own key so concurrent creates never touch the same key
+	err = putIndex(stub, UserIndexPrefix, name)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("- end create User")
 	return nil, nil
 }
 
+// getUser reads a user and fails if it was never created
+// reservedName reports whether a user or farm name would share a key with the chaincode's own state, all of which
+// starts with '_'
+func reservedName(name string) bool {
+	return strings.HasPrefix(name, "_")
+}
+
+func getUser(stub shim.ChaincodeStubInterface, name string) (User, error) {
+	var user User
+	userAsBytes, err := stub.GetState(name)
+	if err != nil {
+		return user, errors.New("Failed to get user " + name)
+	}
+	json.Unmarshal(userAsBytes, &user)
+	if user.Name != name {
+		return user, errors.New("user don't exist")
+	}
+	return user, nil
+}
+
+// putUser writes a user and logs the new version in its history
+func putUser(stub shim.ChaincodeStubInterface, user User) error {
+	userAsBytes, _ := json.Marshal(user)
+	err := stub.PutState(user.Name, userAsBytes)
+	if err != nil {
+		return err
+	}
+	return recordVersion(stub, "user", user.Name, userAsBytes)
+}
+
 // ============================================================================================================================
 // create farm
 // ============================================================================================================================
 func (t *SimpleChaincode) create_farm(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 
-	//   0       1       2     3                4
-	//  'name'   'addre' 'own'  'weathername'  Temperature
-	if len(args) <= 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting >=4")
+	//   0       1       2     3                4             5
+	//  'name'   'addre' 'own'  'weathername'  Temperature  'date'   ... more weather triples
+	if len(args) <= 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting >=6")
 	}
 	stub.PutState("start create farm", []byte(strings.ToLower(args[0])))
 	//input sanitation
 	fmt.Println("- start create farm")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+	if len(args[0]) <= 0 || strings.Contains(args[0], "/") { //a '/' would let one farm's weather range-read into another's
+		return nil, errors.New("1st argument must be a non-empty name without '/'")
+	}
+	if reservedName(args[0]) {
+		return nil, errors.New("Farm names cannot start with _")
 	}
 	if len(args[1]) <= 0 {
 		return nil, errors.New("2nd argument must be a non-empty string")
@@ -301,6 +546,18 @@ func (t *SimpleChaincode) create_farm(stub shim.ChaincodeStubInterface, args []s
 	jsonAsBytes, _ := json.Marshal(newfarm)
 	err = stub.PutState("_debug1", jsonAsBytes)
 
+	if (len(args)-3)%3 != 0 {
+		return nil, errors.New("Initial weather must be given as triples of 'weathername' Temperature 'date'")
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	vocabulary, err := getVocabulary(stub)
+	if err != nil {
+		return nil, err
+	}
+	var seeded []Weather
 	for i := 3; i < len(args); i++ { //create and append each willing trade
 		Temperature, err := strconv.Atoi(args[i+1])
 		if err != nil {
@@ -312,13 +569,19 @@ func (t *SimpleChaincode) create_farm(stub shim.ChaincodeStubInterface, args []s
 		Weather_now := Weather{}
 		Weather_now.Name = args[i]
 		Weather_now.Temperature = Temperature
-		fmt.Println("! created weather: " + args[i])
+		Weather_now.Date = args[i+2]
+		Weather_now.Source = SeedSource
+		Weather_now.Recorded = now
+		err = normalizeWeather(vocabulary, &Weather_now)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("! created weather: " + Weather_now.Name)
 		jsonAsBytes, _ = json.Marshal(Weather_now)
 		err = stub.PutState("_debug2", jsonAsBytes)
 
-		newfarm.WeatherIndex = append(newfarm.WeatherIndex, Weather_now)
-		fmt.Println("! appended weather")
-		i++
+		seeded = append(seeded, Weather_now)
+		i += 2
 	}
 
 	//check if farm already exists
@@ -335,20 +598,23 @@ func (t *SimpleChaincode) create_farm(stub shim.ChaincodeStubInterface, args []s
 		return nil, errors.New("This farm arleady exists") //all stop a user by this name exists
 	}
 
-	newfarmAsBytes, _ := json.Marshal(newfarm)
-	stub.PutState(name, newfarmAsBytes)
-	//get the marble index
-	FarmAsBytes, err = stub.GetState(FarmWeatherIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get marble index")
+	for _, reading := range seeded {
+		_, err = putWeather(stub, &newfarm, reading)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("! stored weather: " + reading.Name)
 	}
-	var FarmIndex []string
 
-	json.Unmarshal(FarmAsBytes, &FarmIndex) //un stringify it aka JSON.parse()
-	//append
-	FarmIndex = append(FarmIndex, name) //add marble name to index list
-	FarmAsBytes, _ = json.Marshal(FarmIndex)
-	err = stub.PutState(FarmWeatherIndexStr, FarmAsBytes) //store name of marble
+	err = putFarm(stub, newfarm)
+	if err != nil {
+		return nil, err
+	}
+	//index the farm under its own key so concurrent creates never touch the same key
+	err = putIndex(stub, FarmIndexPrefix, name)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("- end create User")
 	return nil, nil
@@ -358,6 +624,15 @@ func makeTimestamp() int64 {
 	return time.Now().UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
 }
 
+// txTimestamp returns the transaction timestamp in ms, the same unit as makeTimestamp but agreed on by every peer
+func txTimestamp(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, errors.New("Failed to get transaction timestamp")
+	}
+	return ts.Seconds*1000 + int64(ts.Nanos)/int64(time.Millisecond), nil
+}
+
 // ============================================================================================================================
 // Create User - create a new User,
 // ============================================================================================================================
@@ -365,10 +640,17 @@ func makeTimestamp() int64 {
 func (t *SimpleChaincode) create_insurance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 
-	//   0       1       2     3
-	//  'insurant'   'beneficial' 'Number' 'rate' 'state'
-	if len(args) != 5 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	//   0            1            2        3      4        5          6          7              8        9          10        11
+	//  'insurant'   'beneficial' 'Number' 'rate' 'state' ['trigger' ['premium' 'quote as of' ['plot' ['stage' ['pool' ['rule']]]]]]     premium, as of, plot, stage and pool may be "",
+	//                                                                                                                             a policy from a pool waits for its manager's accept_insurance
+	// or
+	//   0          1       2             3
+	//  'product'  'farm'  'beneficial'  'amount'     everything else comes from the product, see insureProduct
+	if len(args) == 4 {
+		return insureProduct(stub, args)
+	}
+	if len(args) != 5 && len(args) != 6 && len(args) != 8 && len(args) != 9 && len(args) != 10 && len(args) != 11 && len(args) != 12 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4, 5, 6, 8, 9, 10, 11 or 12")
 	}
 
 	//input sanitation
@@ -390,18 +672,82 @@ func (t *SimpleChaincode) create_insurance(stub shim.ChaincodeStubInterface, arg
 	}
 
 	new_insurance := AnInsurance{}
+	new_insurance.ID = stub.GetTxID()
 	new_insurance.Insurant = strings.ToLower(args[0])
 	new_insurance.Beneficiaries = strings.ToLower(args[1])
 	new_insurance.Number, err = strconv.Atoi(args[2])
-	if err != nil {
-		return nil, errors.New("3rd argument must be a numeric string")
+	if err != nil || new_insurance.Number <= 0 { //a negative cover would lower the exposure the limits are checked against
+		return nil, errors.New("3rd argument must be a positive numeric string")
 	}
 	new_insurance.Rate, err = strconv.Atoi(args[3])
-	if err != nil {
-		return nil, errors.New("4rd argument must be a numeric string")
+	if err != nil || new_insurance.Rate <= 0 {
+		return nil, errors.New("4rd argument must be a positive numeric string")
 	}
 	new_insurance.State = strings.ToLower(args[4])
 	new_insurance.Timestamp = makeTimestamp()
+	new_insurance.Trigger = AdverseStreakTrigger
+	if len(args) >= 6 {
+		new_insurance.Trigger, err = strconv.Atoi(args[5])
+		if err != nil || new_insurance.Trigger <= 0 || new_insurance.Trigger > WeatherWindow {
+			return nil, errors.New("6th argument must be a number of days between 1 and " + strconv.Itoa(WeatherWindow))
+		}
+	}
+
+	pricing, err := getPricing(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) >= 9 && len(args[8]) > 0 {
+		new_insurance.Plot = strings.ToLower(args[8])
+		farm, err := getFarm(stub, new_insurance.Insurant)
+		if err != nil {
+			return nil, err
+		}
+		i := findPlot(farm, new_insurance.Plot)
+		if i < 0 {
+			return nil, errors.New("plot not exist")
+		}
+		if len(args) >= 10 && len(args[9]) > 0 {
+			new_insurance.Stage = strings.ToLower(args[9])
+			new_insurance.StageWindow, err = stageWindow(stub, farm.Plots[i], new_insurance.Stage)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if len(args) >= 10 && len(args[9]) > 0 {
+		return nil, errors.New("A stage can only be given for a policy on a plot")
+	}
+	if len(args) == 12 && len(args[11]) > 0 {
+		if _, err = compileRule(args[11]); err != nil {
+			return nil, errors.New("12th argument is not a valid rule: " + err.Error())
+		}
+		new_insurance.Rule = args[11]
+	}
+	if len(args) >= 11 && len(args[10]) > 0 {
+		pool, err := getPool(stub, strings.ToLower(args[10]))
+		if err != nil {
+			return nil, err
+		}
+		new_insurance.Pool = pool.Name
+		new_insurance.Cessions = pool.Treaties
+		new_insurance.State = "proposed" //the pool's manager takes it on, or not, with accept_insurance
+	}
+	if len(args) >= 8 && (len(args[6]) > 0 || len(args[7]) > 0) {
+		if new_insurance.Rule != "" { //quotes price Trigger adverse days in a row, not a rule
+			return nil, errors.New("A policy with a rule cannot be priced yet, leave its premium and quote empty")
+		}
+		new_insurance.Premium, err = strconv.Atoi(args[6])
+		if err != nil {
+			return nil, errors.New("7th argument must be a numeric string")
+		}
+		new_insurance.QuoteAsOf = args[7]
+		err = checkQuote(stub, new_insurance, new_insurance.QuoteAsOf)
+		if err != nil {
+			return nil, err
+		}
+	} else if pricing.RequireQuote {
+		return nil, errors.New("A premium and the as-of date of its quote are required")
+	}
 
 	jsonAsBytes, _ := json.Marshal(new_insurance)
 	err = stub.PutState("_debug1", jsonAsBytes)
@@ -413,27 +759,75 @@ func (t *SimpleChaincode) create_insurance(stub shim.ChaincodeStubInterface, arg
 	}
 	var Insurances ActiveInsurance
 	json.Unmarshal(InsuranceAsBytes, &Insurances) //un stringify it aka JSON.parse()
+	err = checkExposure(stub, Insurances, new_insurance)
+	if err != nil {
+		return nil, err
+	}
+
+	//the insured buys a policy with a premium or from a pool, so nobody can be charged for one they did not ask for
+	//and no manager pays its own pool. A pool's policy waits for its manager to accept it before the premium is taken.
+	if new_insurance.Premium > 0 || new_insurance.Pool != "" {
+		caller, err := callerName(stub)
+		if err != nil {
+			return nil, err
+		}
+		farm, err := getFarm(stub, new_insurance.Insurant)
+		if err != nil {
+			return nil, err
+		}
+		if caller != new_insurance.Beneficiaries && caller != farm.Owner {
+			return nil, errors.New("Only " + new_insurance.Beneficiaries + " or the owner of " + farm.Name + " can buy this policy")
+		}
+		new_insurance.Buyer = caller
+	}
+	if new_insurance.Premium > 0 && new_insurance.Pool == "" {
+		err = escrowPremium(stub, &new_insurance, pricing.TermDays, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	//append
 	Insurances.AllInsurance = append(Insurances.AllInsurance, new_insurance) //add marble name to index list
-	InsuranceAsBytes, _ = json.Marshal(Insurances)
-	err = stub.PutState(ActiveInsuranceStr, InsuranceAsBytes)
+	err = putInsurances(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("- end create User")
 	return nil, nil
 }
 
+// ============================================================================================================================
+// Update Weather - store a new reading for a farm, signed by a station or sent by an oracle, and pay out any policy it triggers
+// ============================================================================================================================
 func (t *SimpleChaincode) update_weather(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 
-	//   0       1       2     3
-	//  'farm_name'   'weather type' 'Temperature'
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	//   0            1              2              3         4
+	//  'farm_name'   'weather type' 'Temperature'  'date'   'source'
+	// or
+	//   0          1
+	//  'report'   'signature'     a station's signed Report JSON and its base64 signature, the station is the source
+	signed := len(args) == 2
+	if signed {
+		args, err = signedReportArgs(stub, args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 5")
+	}
+	if !signed {
+		err = checkUnsignedSource(stub, strings.ToLower(args[4]))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	//input sanitation
-	fmt.Println("- start create user")
+	fmt.Println("- start update weather")
 	if len(args[0]) <= 0 {
 		return nil, errors.New("1st argument must be a non-empty string")
 	}
@@ -441,7 +835,13 @@ func (t *SimpleChaincode) update_weather(stub shim.ChaincodeStubInterface, args
 		return nil, errors.New("2nd argument must be a non-empty string")
 	}
 	if len(args[2]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+		return nil, errors.New("3rd argument must be a non-empty string")
+	}
+	if len(args[3]) <= 0 {
+		return nil, errors.New("4th argument must be a non-empty string")
+	}
+	if len(args[4]) <= 0 {
+		return nil, errors.New("5th argument must be a non-empty string")
 	}
 
 	Temperature, err := strconv.Atoi(args[2])
@@ -450,77 +850,204 @@ func (t *SimpleChaincode) update_weather(stub shim.ChaincodeStubInterface, args
 		fmt.Println(msg)
 		return nil, errors.New(msg)
 	}
+	farmname := strings.ToLower(args[0])
+	update_farm, err := getFarm(stub, farmname)
+	if err != nil {
+		return nil, err
+	}
+
 	Weather_now := Weather{}
 	Weather_now.Name = args[1]
 	Weather_now.Temperature = Temperature
-
-	jsonAsBytes, _ := json.Marshal(Weather_now)
-	err = stub.PutState("_debug2", jsonAsBytes)
-	farmname := strings.ToLower(args[0])
-	farmAsByte, err := stub.GetState(farmname)
+	Weather_now.Date = args[3]
+	Weather_now.Source = strings.ToLower(args[4])
+	Weather_now.Recorded, err = txTimestamp(stub)
 	if err != nil {
-		return nil, errors.New("farm not exist")
+		return nil, err
+	}
+	vocabulary, err := getVocabulary(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = normalizeWeather(vocabulary, &Weather_now)
+	if err != nil {
+		return nil, err
 	}
 
-	var update_farm Farm
-	json.Unmarshal(farmAsByte, &update_farm)
+	stored, err := putWeather(stub, &update_farm, Weather_now)
+	if err != nil {
+		return nil, err
+	}
+	if !stored {
+		return nil, nil
+	}
+	err = putFarm(stub, update_farm)
+	if err != nil {
+		return nil, err
+	}
 
-	jsonAsBytes, _ = json.Marshal(update_farm.WeatherIndex)
+	//check if terrible weather, a late reading can complete a streak as well as extend it
+	err = check_triggers(stub, update_farm)
+	if err != nil {
+		return nil, err
+	}
 
-	err = stub.PutState("_debug4", jsonAsBytes)
+	fmt.Println("- end update weather")
+	return nil, nil
+}
 
-	update_farm.WeatherIndex = append(update_farm.WeatherIndex, Weather_now)
+// check_triggers pays out a farm's policies if its latest weather calls for it. Every reading is checked, a rule can
+// fire on weather that is not adverse, a cold spell or a dry week.
+func check_triggers(stub shim.ChaincodeStubInterface, farm Farm) error {
+	return pay_out_farm(stub, farm)
+}
 
-	farmAsByte, err = json.Marshal(update_farm)
+// ============================================================================================================================
+// Pay out farm - start a payout, held for its challenge period, on every active policy whose rule fires on weather it has not fired on before
+// ============================================================================================================================
+func pay_out_farm(stub shim.ChaincodeStubInterface, farm Farm) error {
+	Insurances, err := getInsurances(stub)
 	if err != nil {
-		return nil, errors.New("farm marshal fail")
+		return err
 	}
-	stub.PutState(farmname, farmAsByte)
 
-	err = stub.PutState("_debug3", farmAsByte)
-
-	//check if terrible weather
-	if len(update_farm.WeatherIndex) >= 3 {
-		var Insurances ActiveInsurance
-		InsuranceAsBytes, err := stub.GetState(ActiveInsuranceStr)
+	changed := false
+	for i, val := range Insurances.AllInsurance {
+		trigger := val.Trigger
+		if trigger <= 0 {
+			trigger = AdverseStreakTrigger
+		}
+		if val.State != "actived" || val.Insurant != farm.Name || !inSeason(farm, val.Plot, trigger) || !inTerm(farm, val) {
+			continue
+		}
+		rule, err := policyRule(val, trigger)
 		if err != nil {
-			return nil, errors.New("insurance get error")
-		}
-		json.Unmarshal(InsuranceAsBytes, &Insurances) //un stringify it aka JSON.parse()
-		bad_count := 0
-		wl := len(update_farm.WeatherIndex)
-		for i := wl - 3; i < wl; i++ {
-			Weather := update_farm.WeatherIndex[i]
-			if Weather.Name == "rainy" {
-				bad_count += 1
-			}
-			if Weather.Name == "sunny" {
-				bad_count = 0
-			}
+			return err
 		}
-		if bad_count >= 3 {
-			for i, val := range Insurances.AllInsurance {
-				if val.State == "actived" && val.Insurant == farmname {
-					Insurances.AllInsurance[i].State = "solved"
-					benefit := val.Number * val.Rate
-					username := val.Beneficiaries
-					var lucky_dog User
-					userAsByte, err := stub.GetState(username)
-					if err != nil {
-						return nil, errors.New("user don't exist")
-					}
-					json.Unmarshal(userAsByte, &lucky_dog)
-					lucky_dog.Coin = lucky_dog.Coin + benefit
-					userAsByte, err = json.Marshal(lucky_dog)
-					stub.PutState(username, userAsByte)
-
-				}
-			}
+		through := val.FiredThrough
+		if val.UpheldThrough > through {
+			through = val.UpheldThrough
+		}
+		fired, err := triggered(rule, unchallenged(farm.Summary.Recent, through))
+		if err != nil {
+			return err
+		}
+		if !fired {
+			continue
+		}
+		staged, err := inStage(stub, farm, val, trigger)
+		if err != nil {
+			return err
 		}
+		if !staged {
+			continue
+		}
+		err = hold_payout(stub, &Insurances.AllInsurance[i], scheduledAmount(val), farm)
+		if err != nil {
+			return err
+		}
+		Insurances.AllInsurance[i].Installments++
+		Insurances.AllInsurance[i].FiredThrough = farm.Summary.LastDate
+		changed = true
+	}
 
-		InsuranceAsBytes, err = json.Marshal(Insurances)
-		stub.PutState(ActiveInsuranceStr, InsuranceAsBytes)
+	if !changed { //every reading gets here, most fire nothing and must not rewrite every policy
+		return nil
 	}
+	return putInsurances(stub, Insurances)
+}
 
-	return nil, nil
+// inSeason reports whether the last trigger days of the farm's weather all fell while the plot's crop was growing,
+// a policy on the whole farm is always in season
+func inSeason(farm Farm, plotID string, trigger int) bool {
+	if plotID == "" {
+		return true
+	}
+	i := findPlot(farm, plotID)
+	if i < 0 || trigger > len(farm.Summary.Recent) {
+		return false
+	}
+	plot := farm.Plots[i]
+	recent := farm.Summary.Recent
+	return plot.growing(recent[len(recent)-trigger].Date) && plot.growing(recent[len(recent)-1].Date)
+}
+
+// inTerm reports whether the farm's latest weather fell before the policy expired
+func inTerm(farm Farm, insurance AnInsurance) bool {
+	recent := farm.Summary.Recent
+	return insurance.Expires == 0 || len(recent) == 0 || recent[len(recent)-1].Observed < insurance.Expires
+}
+
+// pay_insurance credits the beneficiary with up to amount of the policy's remaining cover and returns what was paid.
+// The policy is marked solved once its cover is used up, the caller saves it. The underwriting pool pays, after collecting
+// the reinsurers' shares of amount under the policy's cessions.
+func pay_insurance(stub shim.ChaincodeStubInterface, insurance *AnInsurance, amount int, reason string) (int, error) {
+	remaining := insurance.Number*insurance.Rate - insurance.Paid
+	if amount > remaining {
+		amount = remaining
+	}
+
+	err := settleCessions(stub, *insurance, amount)
+	if err != nil {
+		return 0, err
+	}
+	err = move(stub, payer(*insurance), insurance.Beneficiaries, amount, reason, insurance.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	insurance.Paid += amount
+	if insurance.Paid >= insurance.Number*insurance.Rate {
+		insurance.State = "solved"
+	}
+	return amount, nil
+}
+
+// live reports whether a policy can still pay, active or with a payout waiting on its challenge period
+func (insurance AnInsurance) live() bool {
+	return insurance.State == "actived" || insurance.State == "pending"
+}
+
+// requireUninsured fails while a live policy insures the farm
+func requireUninsured(stub shim.ChaincodeStubInterface, farm string) error {
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return err
+	}
+	for _, val := range Insurances.AllInsurance {
+		if val.Insurant == farm && val.live() {
+			return errors.New("Farm still has an active insurance: " + val.ID)
+		}
+	}
+	return nil
+}
+
+func getInsurances(stub shim.ChaincodeStubInterface) (ActiveInsurance, error) {
+	var Insurances ActiveInsurance
+	InsuranceAsBytes, err := stub.GetState(ActiveInsuranceStr)
+	if err != nil {
+		return Insurances, errors.New("insurance get error")
+	}
+	json.Unmarshal(InsuranceAsBytes, &Insurances) //un stringify it aka JSON.parse()
+	return Insurances, nil
+}
+
+// putInsurances writes the policies and logs a new version of each one that changed
+func putInsurances(stub shim.ChaincodeStubInterface, Insurances ActiveInsurance) error {
+	err := recordPolicyVersions(stub, Insurances)
+	if err != nil {
+		return err
+	}
+	InsuranceAsBytes, _ := json.Marshal(Insurances)
+	return stub.PutState(ActiveInsuranceStr, InsuranceAsBytes)
+}
+
+// findInsurance returns the position of the policy with id, or -1
+func findInsurance(Insurances ActiveInsurance, id string) int {
+	for i, val := range Insurances.AllInsurance {
+		if val.ID == id {
+			return i
+		}
+	}
+	return -1
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPayOutFarmOnePaymentPerFiring(t *testing.T) {
+	stub := newFakeStub(testNow)
+	stub.caller = "oracle1"
+	rolesAsBytes, _ := json.Marshal(Roles{Members: map[string][]string{OracleRole: {"oracle1"}}})
+	stub.state[RolesStr] = rolesAsBytes
+	settingsAsBytes, _ := json.Marshal(DisputeSettings{ChallengeHours: 0})
+	stub.state[DisputeStr] = settingsAsBytes
+	if err := putAccount(stub, Account{Name: InsurerAccount, Balance: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putUser(stub, User{Name: "ben"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putFarm(stub, Farm{Name: "farm1", Owner: "ben"}); err != nil {
+		t.Fatal(err)
+	}
+	policy := AnInsurance{ID: "policy1", Insurant: "farm1", Beneficiaries: "ben", Number: 1, Rate: 100, State: "actived", Trigger: 2, Schedule: []int{2500}}
+	if err := putInsurances(stub, ActiveInsurance{AllInsurance: []AnInsurance{policy}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// two rainy days fire the policy, the next two fire it again, then a sunny day and a late copy of a rainy one must not
+	for _, reading := range [][]string{
+		{"rainy", "2023-11-01"},
+		{"rainy", "2023-11-02"},
+		{"rainy", "2023-11-03"},
+		{"rainy", "2023-11-04"},
+		{"sunny", "2023-11-05"},
+		{"rainy", "2023-11-04"},
+	} {
+		_, err := new(SimpleChaincode).Invoke(stub, "update_weather", []string{"farm1", reading[0], "10", reading[1], "oracle1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Insurances.AllInsurance[0]
+	if got.Installments != 2 || got.Paid != 50 || got.FiredThrough != "2023-11-04" {
+		t.Fatalf("got %d installments paying %d through %s, want 2 paying 50 through 2023-11-04", got.Installments, got.Paid, got.FiredThrough)
+	}
+}
+
+func TestInitIsNotAnInvoke(t *testing.T) {
+	stub := newFakeStub(testNow)
+	stub.caller = "mallory"
+	if _, err := new(SimpleChaincode).Invoke(stub, "init", []string{"1", "", "1000000"}); err == nil {
+		t.Fatal("init ran as an invoke")
+	}
+	if stub.state[RolesStr] != nil {
+		t.Fatal("init as an invoke wrote the roles")
+	}
+}
+
+func TestInit(t *testing.T) {
+	stub := newFakeStub(testNow)
+	stub.caller = "deployer"
+	if _, err := new(SimpleChaincode).Init(stub, "init", []string{"1", "alice", "100"}); err != nil {
+		t.Fatal(err)
+	}
+	if admin, _ := isAdmin(stub, "alice"); !admin {
+		t.Fatal("alice was not made admin")
+	}
+	if admin, _ := isAdmin(stub, "deployer"); admin {
+		t.Fatal("the deployer was made admin instead of alice")
+	}
+	supply, _ := getSupply(stub)
+	insurer, _ := getAccount(stub, InsurerAccount)
+	if supply.Total != 100 || supply.Minted != 100 || insurer.Balance != 100 {
+		t.Fatalf("got supply %+v and insurer balance %d, want 100 minted into the insurer", supply, insurer.Balance)
+	}
+
+	if _, err := new(SimpleChaincode).Init(stub, "init", []string{"1", "mallory"}); err == nil {
+		t.Fatal("Init ran again over an existing coin supply")
+	}
+	supply, _ = getSupply(stub)
+	insurer, _ = getAccount(stub, InsurerAccount)
+	if admin, _ := isAdmin(stub, "mallory"); admin || supply.Total != 100 || insurer.Balance != 100 {
+		t.Fatalf("second Init changed the ledger: supply %+v, insurer balance %d", supply, insurer.Balance)
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	stub := newFakeStub(testNow)
+	rolesAsBytes, _ := json.Marshal(Roles{Members: map[string][]string{AdminRole: {"alice"}}})
+	stub.state[RolesStr] = rolesAsBytes
+	cases := []struct {
+		function string
+		args     []string
+	}{
+		{"create_user", []string{"_roles"}},
+		{"create_user", []string{"_Supply", "0"}},
+		{"create_farm", []string{"_openinsurance", "road 1", "alice", "sunny", "20", "2023-11-14"}},
+	}
+	for _, c := range cases {
+		t.Run(c.function+" "+c.args[0], func(t *testing.T) {
+			before := string(stub.state[RolesStr])
+			if _, err := new(SimpleChaincode).Invoke(stub, c.function, c.args); err == nil || !strings.Contains(err.Error(), "cannot start with _") {
+				t.Fatalf("got error %v, want the name refused", err)
+			}
+			if string(stub.state[RolesStr]) != before || stub.state[ActiveInsuranceStr] != nil || stub.state[SupplyStr] != nil {
+				t.Fatal("a reserved name reached the ledger")
+			}
+		})
+	}
+}
+
+// countingStub counts the writes of every key
+type countingStub struct {
+	*fakeStub
+	puts map[string]int
+}
+
+func (s *countingStub) PutState(key string, value []byte) error {
+	s.puts[key]++
+	return s.fakeStub.PutState(key, value)
+}
+
+func TestPayOutFarmWritesOnlyWhenFired(t *testing.T) {
+	stub := &countingStub{fakeStub: newFakeStub(testNow), puts: map[string]int{}}
+	stub.caller = "oracle1"
+	rolesAsBytes, _ := json.Marshal(Roles{Members: map[string][]string{OracleRole: {"oracle1"}}})
+	stub.state[RolesStr] = rolesAsBytes
+	if err := putFarm(stub, Farm{Name: "farm1", Owner: "ben"}); err != nil {
+		t.Fatal(err)
+	}
+	policy := AnInsurance{ID: "policy1", Insurant: "farm1", Beneficiaries: "ben", Number: 1, Rate: 100, State: "actived", Trigger: 2}
+	if err := putInsurances(stub, ActiveInsurance{AllInsurance: []AnInsurance{policy}}); err != nil {
+		t.Fatal(err)
+	}
+	stub.puts = map[string]int{}
+
+	for _, reading := range [][]string{{"sunny", "2023-11-01"}, {"rainy", "2023-11-02"}} {
+		if _, err := new(SimpleChaincode).Invoke(stub, "update_weather", []string{"farm1", reading[0], "10", reading[1], "oracle1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := stub.puts[ActiveInsuranceStr]; n != 0 {
+		t.Fatalf("readings that fired nothing wrote the policies %d times", n)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var ClaimPrefix = "_claim/" //every claim lives at _claim/<policy>/<claim> so a policy's claims range-read together
+
+type ClaimEvent struct {
+	State     string `json:"state"`     // state the claim moved to
+	By        string `json:"by"`        // user who moved it
+	Amount    int    `json:"amount"`    // amount claimed or approved at this step
+	Note      string `json:"note"`      // description or assessor's remark
+	TxID      string `json:"tx_id"`     // transaction that made the change
+	Timestamp int64  `json:"timestamp"` // ms since epoch
+}
+
+type Claim struct { //an indemnity claim, paid on assessed loss rather than on weather
+	ID          string       `json:"id"`          // transaction ID of file_claim
+	Policy      string       `json:"policy"`      // ID of the policy claimed against
+	Farm        string       `json:"farm"`        // insured farm
+	Claimant    string       `json:"claimant"`    // farm owner who filed it
+	Description string       `json:"description"` // what was lost
+	Amount      int          `json:"amount"`      // coin claimed
+	Approved    int          `json:"approved"`    // coin the assessor allowed
+	Paid        int          `json:"paid"`        // coin actually paid, capped by the policy's remaining cover
+	Assessor    string       `json:"assessor"`    // who decided it
+	State       string       `json:"state"`       // filed approved partial rejected
+	History     []ClaimEvent `json:"history"`     // every state change, oldest first
+}
+
+func claimKey(policy string, id string) string {
+	return ClaimPrefix + policy + "/" + id
+}
+
+func getClaim(stub shim.ChaincodeStubInterface, policy string, id string) (Claim, error) {
+	var claim Claim
+	claimAsBytes, err := stub.GetState(claimKey(policy, id))
+	if err != nil {
+		return claim, errors.New("Failed to get claim " + id)
+	}
+	json.Unmarshal(claimAsBytes, &claim)
+	if claim.ID != id {
+		return claim, errors.New("claim not exist")
+	}
+	return claim, nil
+}
+
+func putClaim(stub shim.ChaincodeStubInterface, claim Claim) error {
+	claimAsBytes, _ := json.Marshal(claim)
+	return stub.PutState(claimKey(claim.Policy, claim.ID), claimAsBytes)
+}
+
+// ============================================================================================================================
+// File Claim - the insured farm's owner claims for a loss against an active policy
+// ============================================================================================================================
+func (t *SimpleChaincode) file_claim(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0          1              2
+	//  'policy'   'description'  'amount'
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start file claim")
+	if len(args[0]) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+	amount, err := strconv.Atoi(args[2])
+	if err != nil || amount <= 0 {
+		return nil, errors.New("3rd argument must be a positive numeric string")
+	}
+
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	i := findInsurance(Insurances, args[0])
+	if i < 0 {
+		return nil, errors.New("insurance not exist")
+	}
+	policy := Insurances.AllInsurance[i]
+	if policy.State != "actived" {
+		return nil, errors.New("Claims can only be filed against an active insurance")
+	}
+
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	farm, err := getFarm(stub, policy.Insurant)
+	if err != nil {
+		return nil, err
+	}
+	if farm.Owner != caller {
+		return nil, errors.New("Only the owner of " + farm.Name + " can file a claim")
+	}
+
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	claim := Claim{}
+	claim.ID = stub.GetTxID()
+	claim.Policy = policy.ID
+	claim.Farm = farm.Name
+	claim.Claimant = caller
+	claim.Description = args[1]
+	claim.Amount = amount
+	claim.State = "filed"
+	claim.History = append(claim.History, ClaimEvent{State: claim.State, By: caller, Amount: amount, Note: args[1], TxID: claim.ID, Timestamp: now})
+
+	err = putClaim(stub, claim)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end file claim")
+	return []byte(claim.ID), nil
+}
+
+// ============================================================================================================================
+// Assess Claim - a registered assessor approves, partially approves or rejects a filed claim and pays what was allowed
+// ============================================================================================================================
+func (t *SimpleChaincode) assess_claim(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0          1         2                                    3          4
+	//  'policy'   'claim'   'approve' | 'partial' | 'reject'    'amount'   'note'      amount is only read for partial
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	fmt.Println("- start assess claim")
+	assessor, err := requireRole(stub, AssessorRole)
+	if err != nil {
+		return nil, err
+	}
+	claim, err := getClaim(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if claim.State != "filed" {
+		return nil, errors.New("Claim has already been assessed")
+	}
+
+	switch strings.ToLower(args[2]) {
+	case "approve":
+		claim.State = "approved"
+		claim.Approved = claim.Amount
+	case "partial":
+		approved, err := strconv.Atoi(args[3])
+		if err != nil || approved <= 0 || approved >= claim.Amount {
+			return nil, errors.New("4th argument must be a numeric string between 0 and the amount claimed")
+		}
+		claim.State = "partial"
+		claim.Approved = approved
+	case "reject":
+		claim.State = "rejected"
+	default:
+		return nil, errors.New("3rd argument must be approve, partial or reject")
+	}
+	claim.Assessor = assessor
+
+	if claim.Approved > 0 {
+		Insurances, err := getInsurances(stub)
+		if err != nil {
+			return nil, err
+		}
+		i := findInsurance(Insurances, claim.Policy)
+		if i < 0 {
+			return nil, errors.New("insurance not exist")
+		}
+		if Insurances.AllInsurance[i].State != "actived" {
+			return nil, errors.New("Insurance is no longer active")
+		}
+		claim.Paid, err = pay_insurance(stub, &Insurances.AllInsurance[i], claim.Approved, ReasonClaim)
+		if err != nil {
+			return nil, err
+		}
+		err = putInsurances(stub, Insurances)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	claim.History = append(claim.History, ClaimEvent{State: claim.State, By: assessor, Amount: claim.Approved, Note: args[4], TxID: stub.GetTxID(), Timestamp: now})
+	err = putClaim(stub, claim)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end assess claim")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get Claims - read every claim filed against a policy
+// ============================================================================================================================
+func (t *SimpleChaincode) get_claims(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'policy'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	iter, err := stub.RangeQueryState(claimKey(args[0], ""), claimKey(args[0], "~"))
+	if err != nil {
+		return nil, errors.New("Failed to range over claims of " + args[0])
+	}
+	defer iter.Close()
+
+	var claims []Claim
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var claim Claim
+		json.Unmarshal(valAsbytes, &claim)
+		claims = append(claims, claim)
+	}
+	return json.Marshal(claims)
+}
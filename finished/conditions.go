@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var ConditionsStr = "_conditions" //name for the key/value that will store the weather condition vocabulary
+
+var Adverse = "adverse"       //weather that counts towards a payout
+var Neutral = "neutral"       //weather that neither helps nor hurts
+var Favourable = "favourable" //weather that ends a bad run
+
+type Condition struct {
+	Name     string   `json:"name"`     // canonical name stored on readings
+	Aliases  []string `json:"aliases"`  // other spellings normalized to Name
+	Severity string   `json:"severity"` // adverse neutral favourable
+}
+
+type Vocabulary struct {
+	Conditions []Condition `json:"conditions"`
+}
+
+// defaultVocabulary is what Init starts the ledger with, it covers everything the old payout rule understood
+func defaultVocabulary() Vocabulary {
+	return Vocabulary{Conditions: []Condition{
+		{Name: "rainy", Aliases: []string{"rain", "showers", "wet"}, Severity: Adverse},
+		{Name: "frost", Aliases: []string{"frosty", "freeze"}, Severity: Adverse},
+		{Name: "cloudy", Aliases: []string{"cloud", "overcast"}, Severity: Neutral},
+		{Name: "sunny", Aliases: []string{"sun", "clear", "fair"}, Severity: Favourable},
+	}}
+}
+
+func getVocabulary(stub shim.ChaincodeStubInterface) (Vocabulary, error) {
+	var vocabulary Vocabulary
+	vocabularyAsBytes, err := stub.GetState(ConditionsStr)
+	if err != nil {
+		return vocabulary, errors.New("Failed to get weather conditions")
+	}
+	json.Unmarshal(vocabularyAsBytes, &vocabulary)
+	return vocabulary, nil
+}
+
+// lookup finds the condition a name or alias refers to, matching ignores case and surrounding space
+func (v Vocabulary) lookup(name string) (Condition, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, condition := range v.Conditions {
+		if condition.Name == name {
+			return condition, true
+		}
+		for _, alias := range condition.Aliases {
+			if alias == name {
+				return condition, true
+			}
+		}
+	}
+	return Condition{}, false
+}
+
+// normalizeWeather rewrites a reading's condition to its canonical name and severity, unknown conditions are rejected
+func normalizeWeather(vocabulary Vocabulary, reading *Weather) error {
+	condition, ok := vocabulary.lookup(reading.Name)
+	if !ok {
+		return errors.New("Unknown weather condition: " + reading.Name)
+	}
+	reading.Name = condition.Name
+	reading.Severity = condition.Severity
+	return nil
+}
+
+// ============================================================================================================================
+// Set Condition - add a weather condition to the vocabulary or replace its severity and aliases, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) set_condition(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1           2 ...
+	//  'name'  'severity'  'alias' ...
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting >=2")
+	}
+
+	fmt.Println("- start set condition")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+	severity := strings.ToLower(args[1])
+	if severity != Adverse && severity != Neutral && severity != Favourable {
+		return nil, errors.New("2nd argument must be one of adverse, neutral, favourable")
+	}
+
+	condition := Condition{Name: strings.ToLower(strings.TrimSpace(args[0])), Severity: severity}
+	for _, alias := range args[2:] {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		if len(alias) <= 0 {
+			return nil, errors.New("Aliases must be non-empty strings")
+		}
+		condition.Aliases = append(condition.Aliases, alias)
+	}
+
+	vocabulary, err := getVocabulary(stub)
+	if err != nil {
+		return nil, err
+	}
+	var kept []Condition
+	for _, existing := range vocabulary.Conditions {
+		if existing.Name != condition.Name {
+			kept = append(kept, existing)
+		}
+	}
+	//a name or alias may only ever mean one condition
+	others := Vocabulary{Conditions: kept}
+	for _, name := range append([]string{condition.Name}, condition.Aliases...) {
+		if clash, ok := others.lookup(name); ok {
+			return nil, errors.New(name + " already refers to " + clash.Name)
+		}
+	}
+	vocabulary.Conditions = append(kept, condition)
+
+	jsonAsBytes, _ := json.Marshal(vocabulary)
+	err = stub.PutState(ConditionsStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end set condition")
+	return nil, nil
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var DisputeStr = "_dispute"                 //name for the key/value that will store the challenge period
+var PayoutPrefix = "_payout/"               //every held weather payout lives at _payout/<id>
+var PendingPayoutPrefix = "_pendingpayout/" //unchallenged payouts wait at _pendingpayout/<deadline>/<id> so the sweep range-reads the due ones
+
+var ReasonCessionReversal = "cession_reversal" //a rejected payout's ceded shares handed back to the reinsurers
+
+type DisputeSettings struct {
+	ChallengeHours int `json:"challenge_hours"` // how long a weather payout is held open to challenge, 0 pays at once
+}
+
+type Challenge struct {
+	By        string    `json:"by"`        // who challenged
+	Note      string    `json:"note"`      // why
+	Evidence  []Weather `json:"evidence"`  // other readings of the farm, as stored when the challenge was made
+	TxID      string    `json:"tx_id"`     // transaction that challenged
+	Timestamp int64     `json:"timestamp"` // ms since epoch
+}
+
+type Payout struct { //a weather payout held in escrow until its challenge period is over
+	ID         string     `json:"id"`         // <tx id>-<policy> of the weather update that triggered it
+	Policy     string     `json:"policy"`     // policy that triggered
+	Farm       string     `json:"farm"`       // insured farm
+	Amount     int        `json:"amount"`     // coin held for the beneficiary
+	Escrow     string     `json:"escrow"`     // escrow holding Amount, "" while unfunded
+	Readings   []Weather  `json:"readings"`   // the farm's recent weather that triggered it
+	Deadline   int64      `json:"deadline"`   // ms since epoch, challenges are taken until then, 0 while unfunded
+	State      string     `json:"state"`      // unfunded pending challenged paid rejected
+	Challenge  *Challenge `json:"challenge"`  // nil unless challenged
+	Arbitrator string     `json:"arbitrator"` // who resolved the challenge
+	Resolution string     `json:"resolution"` // arbitrator's remark
+}
+
+func defaultDisputeSettings() DisputeSettings {
+	return DisputeSettings{ChallengeHours: 48}
+}
+
+func getDisputeSettings(stub shim.ChaincodeStubInterface) (DisputeSettings, error) {
+	settings := defaultDisputeSettings()
+	settingsAsBytes, err := stub.GetState(DisputeStr)
+	if err != nil {
+		return settings, errors.New("Failed to get dispute settings")
+	}
+	json.Unmarshal(settingsAsBytes, &settings)
+	return settings, nil
+}
+
+func pendingPayoutKey(payout Payout) string {
+	return fmt.Sprintf("%s%013d/%s", PendingPayoutPrefix, payout.Deadline, payout.ID)
+}
+
+func getPayout(stub shim.ChaincodeStubInterface, id string) (Payout, error) {
+	var payout Payout
+	payoutAsBytes, err := stub.GetState(PayoutPrefix + id)
+	if err != nil {
+		return payout, errors.New("Failed to get payout " + id)
+	}
+	json.Unmarshal(payoutAsBytes, &payout)
+	if payout.ID != id {
+		return payout, errors.New("payout not exist")
+	}
+	return payout, nil
+}
+
+func putPayout(stub shim.ChaincodeStubInterface, payout Payout) error {
+	payoutAsBytes, _ := json.Marshal(payout)
+	return stub.PutState(PayoutPrefix+payout.ID, payoutAsBytes)
+}
+
+// fundable reports whether the reinsurers can pay their shares of amount and the payer can then pay it in full
+func fundable(stub shim.ChaincodeStubInterface, insurance AnInsurance, amount int) (bool, error) {
+	payer, err := getAccount(stub, payer(insurance))
+	if err != nil {
+		return false, err
+	}
+	available := payer.Balance
+	for _, treaty := range insurance.Cessions {
+		ceded := amount * treaty.CedeBP / 10000
+		reinsurer, err := getAccount(stub, poolAccount(treaty.Reinsurer))
+		if err != nil {
+			return false, err
+		}
+		if reinsurer.Balance < ceded {
+			return false, nil
+		}
+		available += ceded
+	}
+	return available >= amount, nil
+}
+
+// hold_payout starts a weather payout of up to amount of the policy's remaining cover and leaves the policy pending
+// until it is decided. When the pool or a reinsurer cannot cover it yet the payout is recorded as unfunded, so the
+// weather that triggered it is still stored, and fund_payout starts it later. The caller saves the policy.
+func hold_payout(stub shim.ChaincodeStubInterface, insurance *AnInsurance, amount int, farm Farm) error {
+	remaining := insurance.Number*insurance.Rate - insurance.Paid
+	if amount > remaining {
+		amount = remaining
+	}
+	payout := Payout{ID: stub.GetTxID() + "-" + insurance.ID, Policy: insurance.ID, Farm: farm.Name, Amount: amount, State: "unfunded"}
+	payout.Readings = farm.Summary.Recent
+	insurance.State = "pending"
+
+	funded, err := fundable(stub, *insurance, amount)
+	if err != nil {
+		return err
+	}
+	if !funded {
+		fmt.Println("! payout unfunded: " + payout.ID)
+		return putPayout(stub, payout)
+	}
+	return fundPayout(stub, insurance, &payout)
+}
+
+// fundPayout has the reinsurers settle with the pool and puts the pool's coin into escrow for the beneficiary until
+// the challenge period is over. With no challenge period it pays at once through pay_insurance.
+func fundPayout(stub shim.ChaincodeStubInterface, insurance *AnInsurance, payout *Payout) error {
+	settings, err := getDisputeSettings(stub)
+	if err != nil {
+		return err
+	}
+	if settings.ChallengeHours <= 0 {
+		insurance.State = "actived"
+		payout.State = "paid"
+		payout.Amount, err = pay_insurance(stub, insurance, payout.Amount, ReasonPayout)
+		if err != nil {
+			return err
+		}
+		return putPayout(stub, *payout)
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	err = settleCessions(stub, *insurance, payout.Amount)
+	if err != nil {
+		return err
+	}
+	escrow, err := openEscrow(stub, payer(*insurance), insurance.Beneficiaries, payout.Amount, ReasonPayout, insurance.ID, EscrowConditions{Managed: true})
+	if err != nil {
+		return err
+	}
+	payout.Escrow = escrow.ID
+	payout.State = "pending"
+	payout.Deadline = now + int64(settings.ChallengeHours)*60*60*1000
+	err = putPayout(stub, *payout)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(pendingPayoutKey(*payout), []byte(payout.ID))
+}
+
+// decidePayout releases a held payout to the beneficiary and counts it against the cover, or when paid is false
+// refunds it to the pool, reverses the reinsurers' shares and keeps the payout's weather from triggering the policy
+// again. Either way the policy leaves pending.
+func decidePayout(stub shim.ChaincodeStubInterface, Insurances *ActiveInsurance, payout *Payout, paid bool, by string) error {
+	i := findInsurance(*Insurances, payout.Policy)
+	if i < 0 {
+		return errors.New("insurance not exist")
+	}
+	insurance := &Insurances.AllInsurance[i]
+	escrow, err := getEscrow(stub, payout.Escrow)
+	if err != nil {
+		return err
+	}
+	err = settleEscrow(stub, &escrow, paid, by)
+	if err != nil {
+		return err
+	}
+
+	insurance.State = "actived"
+	if paid {
+		payout.State = "paid"
+		insurance.Paid += payout.Amount
+		if insurance.Paid >= insurance.Number*insurance.Rate {
+			insurance.State = "solved"
+		}
+	} else {
+		payout.State = "rejected"
+		insurance.Installments--
+		if n := len(payout.Readings); n > 0 && payout.Readings[n-1].Date > insurance.UpheldThrough {
+			insurance.UpheldThrough = payout.Readings[n-1].Date //the contested days must not trigger the policy again
+		}
+		for _, treaty := range insurance.Cessions {
+			ceded := payout.Amount * treaty.CedeBP / 10000
+			err = move(stub, payer(*insurance), poolAccount(treaty.Reinsurer), ceded, ReasonCessionReversal, insurance.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return putPayout(stub, *payout)
+}
+
+// unchallenged drops the days up to through, weather that already fired a policy or that a challenge was upheld against
+func unchallenged(days []Weather, through string) []Weather {
+	for len(days) > 0 && days[0].Date <= through {
+		days = days[1:]
+	}
+	return days
+}
+
+// ============================================================================================================================
+// Challenge Payout - the insurer disputes a pending weather payout with other readings of the farm
+// ============================================================================================================================
+func (t *SimpleChaincode) challenge_payout(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0         1       2       3         4       5
+	//  'payout'  'note'  'date'  'source'  ['date'  'source' ...]     each date and source names a stored reading of the farm
+	if len(args) < 4 || len(args)%2 != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting payout, note and pairs of date and source")
+	}
+
+	fmt.Println("- start challenge payout")
+	payout, err := getPayout(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	if payout.State != "pending" || now >= payout.Deadline {
+		return nil, errors.New("Payout " + payout.ID + " can no longer be challenged")
+	}
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	i := findInsurance(Insurances, payout.Policy)
+	if i < 0 {
+		return nil, errors.New("insurance not exist")
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	if pool := Insurances.AllInsurance[i].Pool; pool != "" {
+		if _, err = managedPool(stub, pool); err != nil {
+			return nil, err
+		}
+	} else if _, err = requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+
+	challenge := Challenge{By: caller, Note: args[1], TxID: stub.GetTxID(), Timestamp: now}
+	for n := 2; n < len(args); n += 2 {
+		var reading Weather
+		readingAsBytes, err := stub.GetState(weatherKey(payout.Farm, args[n], strings.ToLower(args[n+1])))
+		if err != nil {
+			return nil, errors.New("Failed to get reading of " + args[n])
+		}
+		if readingAsBytes == nil {
+			return nil, errors.New("No reading of " + payout.Farm + " on " + args[n] + " from " + args[n+1])
+		}
+		json.Unmarshal(readingAsBytes, &reading)
+		challenge.Evidence = append(challenge.Evidence, reading)
+	}
+
+	payout.State = "challenged"
+	payout.Challenge = &challenge
+	err = putPayout(stub, payout)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(pendingPayoutKey(payout))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end challenge payout")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Resolve Challenge - an arbitrator upholds a challenge and the payout goes back to the pool, or dismisses it and it is paid
+// ============================================================================================================================
+func (t *SimpleChaincode) resolve_challenge(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0         1                       2
+	//  'payout'  'uphold' | 'dismiss'    'note'
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start resolve challenge")
+	arbitrator, err := requireRole(stub, ArbitratorRole)
+	if err != nil {
+		return nil, err
+	}
+	payout, err := getPayout(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if payout.State != "challenged" {
+		return nil, errors.New("Payout " + payout.ID + " is not challenged")
+	}
+	decision := strings.ToLower(args[1])
+	if decision != "uphold" && decision != "dismiss" {
+		return nil, errors.New("2nd argument must be uphold or dismiss")
+	}
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	payout.Arbitrator = arbitrator
+	payout.Resolution = args[2]
+	err = decidePayout(stub, &Insurances, &payout, decision == "dismiss", arbitrator)
+	if err != nil {
+		return nil, err
+	}
+	err = putInsurances(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end resolve challenge")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Finalize Payouts - pay every unchallenged payout whose challenge period is over, anyone may sweep
+// ============================================================================================================================
+func (t *SimpleChaincode) finalize_payouts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	fmt.Println("- start finalize payouts")
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := stub.RangeQueryState(PendingPayoutPrefix, fmt.Sprintf("%s%013d/%s", PendingPayoutPrefix, now, KeyMax)) //due at now too, challenges end then
+	if err != nil {
+		return nil, errors.New("Failed to range over pending payouts")
+	}
+	var keys, ids []string
+	for iter.HasNext() {
+		key, idAsBytes, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+		ids = append(ids, string(idAsBytes))
+	}
+	iter.Close()
+
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	for n, id := range ids {
+		payout, err := getPayout(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		err = decidePayout(stub, &Insurances, &payout, true, "")
+		if err != nil {
+			return nil, err
+		}
+		err = stub.DelState(keys[n])
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = putInsurances(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end finalize payouts")
+	return []byte(strconv.Itoa(len(ids))), nil
+}
+
+// ============================================================================================================================
+// Fund Payout - start an unfunded payout once the pool and its reinsurers can cover it, anyone may retry
+// ============================================================================================================================
+func (t *SimpleChaincode) fund_payout(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'payout'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	fmt.Println("- start fund payout")
+	payout, err := getPayout(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if payout.State != "unfunded" {
+		return nil, errors.New("Payout " + payout.ID + " is already " + payout.State)
+	}
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	i := findInsurance(Insurances, payout.Policy)
+	if i < 0 {
+		return nil, errors.New("insurance not exist")
+	}
+	insurance := &Insurances.AllInsurance[i]
+	funded, err := fundable(stub, *insurance, payout.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if !funded {
+		return nil, errors.New(payer(*insurance) + " or its reinsurers still cannot cover " + strconv.Itoa(payout.Amount) + " coin")
+	}
+	err = fundPayout(stub, insurance, &payout)
+	if err != nil {
+		return nil, err
+	}
+	err = putInsurances(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end fund payout")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get Payout - read a held weather payout and any challenge against it
+// ============================================================================================================================
+func (t *SimpleChaincode) get_payout(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'payout'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	payout, err := getPayout(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(payout)
+}
+
+// ============================================================================================================================
+// Set Challenge Period - change how long weather payouts are held open to challenge, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) set_challenge_period(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'hours'     0 pays weather payouts at once
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	fmt.Println("- start set challenge period")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	hours, err := strconv.Atoi(args[0])
+	if err != nil || hours < 0 {
+		return nil, errors.New("1st argument must be a non-negative numeric string")
+	}
+
+	settingsAsBytes, _ := json.Marshal(DisputeSettings{ChallengeHours: hours})
+	err = stub.PutState(DisputeStr, settingsAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end set challenge period")
+	return nil, nil
+}
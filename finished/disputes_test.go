@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// disputeStub holds a 100 coin payout of policy1 to ben, half of it ceded to the re1 pool, open to challenge for 48 hours
+func disputeStub(t *testing.T) *fakeStub {
+	stub := newFakeStub(testNow)
+	rolesAsBytes, _ := json.Marshal(Roles{Members: map[string][]string{ArbitratorRole: {"judge"}}})
+	stub.state[RolesStr] = rolesAsBytes
+	settingsAsBytes, _ := json.Marshal(DisputeSettings{ChallengeHours: 48})
+	stub.state[DisputeStr] = settingsAsBytes
+	if err := putAccount(stub, Account{Name: InsurerAccount, Balance: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putAccount(stub, Account{Name: poolAccount("re1"), Balance: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putUser(stub, User{Name: "ben"}); err != nil {
+		t.Fatal(err)
+	}
+	farm := Farm{Name: "farm1", Owner: "ben"}
+	farm.Summary.Recent = []Weather{{Date: "2023-11-01"}, {Date: "2023-11-02"}}
+	if err := putFarm(stub, farm); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := AnInsurance{ID: "policy1", Insurant: "farm1", Beneficiaries: "ben", Number: 2, Rate: 100, State: "actived", Trigger: 2, Installments: 1,
+		Cessions: []Treaty{{Reinsurer: "re1", CedeBP: 5000}}}
+	if err := hold_payout(stub, &policy, 100, farm); err != nil {
+		t.Fatal(err)
+	}
+	if err := putInsurances(stub, ActiveInsurance{AllInsurance: []AnInsurance{policy}}); err != nil {
+		t.Fatal(err)
+	}
+	return stub
+}
+
+// challenge marks the payout challenged and takes it out of the sweep, as challenge_payout does
+func challenge(t *testing.T, stub *fakeStub) {
+	payout, err := getPayout(stub, "tx1-policy1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.DelState(pendingPayoutKey(payout))
+	payout.State = "challenged"
+	payout.Challenge = &Challenge{By: "alice", Note: "the station was sunny"}
+	if err := putPayout(stub, payout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecidePayout(t *testing.T) {
+	cases := []struct {
+		name          string
+		decide        func(t *testing.T, stub *fakeStub) ([]byte, error)
+		finalized     string // count finalize_payouts returns, "" when it is not the sweep deciding
+		payout        string
+		policy        string
+		paid          int
+		installments  int
+		upheldThrough string
+		ben           int
+		insurer       int
+		reinsurer     int
+	}{
+		{"dismiss", func(t *testing.T, stub *fakeStub) ([]byte, error) {
+			challenge(t, stub)
+			stub.caller = "judge"
+			return new(SimpleChaincode).Invoke(stub, "resolve_challenge", []string{"tx1-policy1", "dismiss", "the farm's own readings stand"})
+		}, "", "paid", "actived", 100, 1, "", 100, 950, 150},
+		{"uphold", func(t *testing.T, stub *fakeStub) ([]byte, error) {
+			challenge(t, stub)
+			stub.caller = "judge"
+			return new(SimpleChaincode).Invoke(stub, "resolve_challenge", []string{"tx1-policy1", "uphold", "the station was right"})
+		}, "", "rejected", "actived", 0, 0, "2023-11-02", 0, 1000, 200},
+		{"finalize when due", func(t *testing.T, stub *fakeStub) ([]byte, error) {
+			stub.now += 48 * 60 * 60 * 1000
+			return new(SimpleChaincode).Invoke(stub, "finalize_payouts", []string{})
+		}, "1", "paid", "actived", 100, 1, "", 100, 950, 150},
+		{"finalize too early", func(t *testing.T, stub *fakeStub) ([]byte, error) {
+			stub.now += 48*60*60*1000 - 1
+			return new(SimpleChaincode).Invoke(stub, "finalize_payouts", []string{})
+		}, "0", "pending", "pending", 0, 1, "", 0, 950, 150},
+		{"finalize skips a challenged payout", func(t *testing.T, stub *fakeStub) ([]byte, error) {
+			challenge(t, stub)
+			stub.now += 48 * 60 * 60 * 1000
+			return new(SimpleChaincode).Invoke(stub, "finalize_payouts", []string{})
+		}, "0", "challenged", "pending", 0, 1, "", 0, 950, 150},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := disputeStub(t)
+			result, err := c.decide(t, stub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.finalized != "" && string(result) != c.finalized {
+				t.Fatalf("finalize_payouts paid %s payouts, want %s", result, c.finalized)
+			}
+
+			payout, _ := getPayout(stub, "tx1-policy1")
+			Insurances, _ := getInsurances(stub)
+			policy := Insurances.AllInsurance[0]
+			if payout.State != c.payout || policy.State != c.policy {
+				t.Fatalf("got payout %s and policy %s, want %s and %s", payout.State, policy.State, c.payout, c.policy)
+			}
+			if policy.Paid != c.paid || policy.Installments != c.installments || policy.UpheldThrough != c.upheldThrough {
+				t.Fatalf("got paid %d installments %d upheld through %q, want %d %d %q", policy.Paid, policy.Installments, policy.UpheldThrough, c.paid, c.installments, c.upheldThrough)
+			}
+			ben, _ := getUser(stub, "ben")
+			insurer, _ := getAccount(stub, InsurerAccount)
+			reinsurer, _ := getAccount(stub, poolAccount("re1"))
+			if ben.Coin != c.ben || insurer.Balance != c.insurer || reinsurer.Balance != c.reinsurer {
+				t.Fatalf("got ben %d insurer %d reinsurer %d, want %d %d %d", ben.Coin, insurer.Balance, reinsurer.Balance, c.ben, c.insurer, c.reinsurer)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var EscrowPrefix = "_escrow/" //every escrow lives at _escrow/<tx id>-<n>
+var EscrowAccount = "@escrow" //holds the coin of every escrow that is still held
+
+var ReasonEscrow = "escrow_hold"   //coin put into escrow, the release is journaled under the escrow's own reason
+var ReasonRefund = "escrow_refund" //escrowed coin given back to its holder
+
+type EscrowConditions struct {
+	Releasers    []string `json:"releasers"`     // users who may release, anyone may when empty
+	ReleaseAfter int64    `json:"release_after"` // ms since epoch, no release before it
+	Refunders    []string `json:"refunders"`     // users who may refund before Expires, admins always may
+	Expires      int64    `json:"expires"`       // ms since epoch, after it the escrow can only be refunded and anyone may, 0 for never
+	Managed      bool     `json:"managed"`       // only the chaincode settles it, release_escrow and refund_escrow refuse it
+}
+
+type Escrow struct {
+	ID          string           `json:"id"`          // <tx id>-<n> of the transaction that opened it
+	Holder      string           `json:"holder"`      // account the coin came from and is refunded to
+	Beneficiary string           `json:"beneficiary"` // account the coin is released to
+	Amount      int              `json:"amount"`      // coin held
+	Reason      string           `json:"reason"`      // what the coin is for, the release is journaled under it
+	Policy      string           `json:"policy"`      // policy it belongs to, "" if none
+	Conditions  EscrowConditions `json:"conditions"`
+	State       string           `json:"state"`      // held released refunded
+	Settled     int64            `json:"settled"`    // ms since epoch it was released or refunded
+	SettledBy   string           `json:"settled_by"` // user who released or refunded it, "" when the chaincode did
+}
+
+func getEscrow(stub shim.ChaincodeStubInterface, id string) (Escrow, error) {
+	var escrow Escrow
+	escrowAsBytes, err := stub.GetState(EscrowPrefix + id)
+	if err != nil {
+		return escrow, errors.New("Failed to get escrow " + id)
+	}
+	json.Unmarshal(escrowAsBytes, &escrow)
+	if escrow.ID != id {
+		return escrow, errors.New("escrow not exist")
+	}
+	return escrow, nil
+}
+
+func putEscrow(stub shim.ChaincodeStubInterface, escrow Escrow) error {
+	escrowAsBytes, _ := json.Marshal(escrow)
+	return stub.PutState(EscrowPrefix+escrow.ID, escrowAsBytes)
+}
+
+// heldEscrowOf returns the ID of an escrow still held that account would be refunded or released from, "" if none
+func heldEscrowOf(stub shim.ChaincodeStubInterface, account string) (string, error) {
+	iter, err := stub.RangeQueryState(EscrowPrefix, EscrowPrefix+"~")
+	if err != nil {
+		return "", errors.New("Failed to range over escrows")
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		_, escrowAsBytes, err := iter.Next()
+		if err != nil {
+			return "", err
+		}
+		var escrow Escrow
+		json.Unmarshal(escrowAsBytes, &escrow)
+		if escrow.State == "held" && (escrow.Holder == account || escrow.Beneficiary == account) {
+			return escrow.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// openEscrow moves amount from holder into EscrowAccount and records what it is held for under the first free ID
+// of this transaction
+func openEscrow(stub shim.ChaincodeStubInterface, holder string, beneficiary string, amount int, reason string, policy string, conditions EscrowConditions) (Escrow, error) {
+	escrow := Escrow{Holder: holder, Beneficiary: beneficiary, Amount: amount, Reason: reason, Policy: policy, Conditions: conditions, State: "held"}
+	for n := 0; ; n++ {
+		escrow.ID = fmt.Sprintf("%s-%d", stub.GetTxID(), n)
+		existing, err := stub.GetState(EscrowPrefix + escrow.ID)
+		if err != nil {
+			return escrow, errors.New("Failed to get escrow " + escrow.ID)
+		}
+		if existing == nil {
+			break
+		}
+	}
+	err := move(stub, holder, EscrowAccount, amount, ReasonEscrow, policy)
+	if err != nil {
+		return escrow, err
+	}
+	return escrow, putEscrow(stub, escrow)
+}
+
+// settleEscrow pays a held escrow out to its beneficiary when release is true and back to its holder otherwise.
+// It does not check the conditions, release_escrow and refund_escrow do that for users.
+func settleEscrow(stub shim.ChaincodeStubInterface, escrow *Escrow, release bool, by string) error {
+	if escrow.State != "held" {
+		return errors.New("Escrow " + escrow.ID + " is already " + escrow.State)
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	if release {
+		err = move(stub, EscrowAccount, escrow.Beneficiary, escrow.Amount, escrow.Reason, escrow.Policy)
+		escrow.State = "released"
+	} else {
+		err = move(stub, EscrowAccount, escrow.Holder, escrow.Amount, ReasonRefund, escrow.Policy)
+		escrow.State = "refunded"
+	}
+	if err != nil {
+		return err
+	}
+	escrow.Settled = now
+	escrow.SettledBy = by
+	return putEscrow(stub, *escrow)
+}
+
+func listed(names []string, name string) bool {
+	for _, val := range names {
+		if val == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// Release Escrow - pay a held escrow to its beneficiary once its release conditions are met
+// ============================================================================================================================
+func (t *SimpleChaincode) release_escrow(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'escrow'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	fmt.Println("- start release escrow")
+	escrow, err := getEscrow(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	conditions := escrow.Conditions
+	if conditions.Managed {
+		return nil, errors.New("Escrow " + escrow.ID + " is settled by the chaincode")
+	}
+	if len(conditions.Releasers) > 0 && !listed(conditions.Releasers, caller) {
+		return nil, errors.New(caller + " may not release escrow " + escrow.ID)
+	}
+	if now < conditions.ReleaseAfter {
+		return nil, errors.New("Escrow " + escrow.ID + " cannot be released yet")
+	}
+	if conditions.Expires > 0 && now >= conditions.Expires {
+		return nil, errors.New("Escrow " + escrow.ID + " has expired and can only be refunded")
+	}
+
+	err = settleEscrow(stub, &escrow, true, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end release escrow")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Refund Escrow - give a held escrow back to its holder, by a refunder or an admin, or by anyone once it has expired
+// ============================================================================================================================
+func (t *SimpleChaincode) refund_escrow(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'escrow'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	fmt.Println("- start refund escrow")
+	escrow, err := getEscrow(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := isAdmin(stub, caller)
+	if err != nil {
+		return nil, err
+	}
+	conditions := escrow.Conditions
+	if conditions.Managed {
+		return nil, errors.New("Escrow " + escrow.ID + " is settled by the chaincode")
+	}
+	expired := conditions.Expires > 0 && now >= conditions.Expires
+	if !expired && !admin && !listed(conditions.Refunders, caller) {
+		return nil, errors.New(caller + " may not refund escrow " + escrow.ID)
+	}
+
+	err = settleEscrow(stub, &escrow, false, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end refund escrow")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get Escrow - read an escrow and its conditions
+// ============================================================================================================================
+func (t *SimpleChaincode) get_escrow(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'escrow'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	escrow, err := getEscrow(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(escrow)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var LimitsStr = "_limits" //name for the key/value that will store the solvency and concentration limits
+
+type Limits struct { //0 turns a limit off
+	MinCapitalBP int `json:"min_capital_bp"` // capital a pool must hold as a share of its exposure, 10000 = fully funded
+	ZoneLimit    int `json:"zone_limit"`     // most cover that may be open on the farms of one weather zone
+	FarmLimit    int `json:"farm_limit"`     // most cover that may be open on one farm
+}
+
+type PoolExposure struct {
+	Exposure  int `json:"exposure"`   // remaining cover the account would pay, net of what it cedes and with what it accepts
+	Capital   int `json:"capital"`    // the account's balance
+	CapitalBP int `json:"capital_bp"` // Capital as a share of Exposure, 0 when there is no exposure
+}
+
+type Exposure struct {
+	Limits Limits                  `json:"limits"`
+	Pools  map[string]PoolExposure `json:"pools"` // by the account payouts are charged to, see payer
+	Zones  map[string]int          `json:"zones"` // remaining cover on each zone's farms
+	Farms  map[string]int          `json:"farms"` // remaining cover on each farm
+}
+
+func defaultLimits() Limits {
+	return Limits{MinCapitalBP: 10000}
+}
+
+func getLimits(stub shim.ChaincodeStubInterface) (Limits, error) {
+	limits := defaultLimits()
+	limitsAsBytes, err := stub.GetState(LimitsStr)
+	if err != nil {
+		return limits, errors.New("Failed to get limits")
+	}
+	json.Unmarshal(limitsAsBytes, &limits)
+	return limits, nil
+}
+
+// exposures adds up the remaining cover of every live policy by paying account, zone and farm
+func exposures(stub shim.ChaincodeStubInterface, Insurances ActiveInsurance) (Exposure, error) {
+	exposure := Exposure{Pools: map[string]PoolExposure{}, Zones: map[string]int{}, Farms: map[string]int{}}
+	pools := map[string]int{}
+	farms := map[string]Farm{}
+	for _, insurance := range Insurances.AllInsurance {
+		if !insurance.live() {
+			continue
+		}
+		remaining := insurance.Number*insurance.Rate - insurance.Paid
+		retained := remaining
+		for _, treaty := range insurance.Cessions {
+			ceded := remaining * treaty.CedeBP / 10000
+			pools[poolAccount(treaty.Reinsurer)] += ceded
+			retained -= ceded
+		}
+		pools[payer(insurance)] += retained
+
+		farm, ok := farms[insurance.Insurant]
+		if !ok {
+			var err error
+			farm, err = getFarm(stub, insurance.Insurant)
+			if err != nil {
+				return exposure, err
+			}
+			farms[farm.Name] = farm
+		}
+		exposure.Farms[farm.Name] += remaining
+		if farm.Zone != "" {
+			exposure.Zones[farm.Zone] += remaining
+		}
+	}
+
+	for name, amount := range pools {
+		account, err := getAccount(stub, name)
+		if err != nil {
+			return exposure, err
+		}
+		pool := PoolExposure{Exposure: amount, Capital: account.Balance}
+		if amount > 0 {
+			pool.CapitalBP = account.Balance * 10000 / amount
+		}
+		exposure.Pools[name] = pool
+	}
+	return exposure, nil
+}
+
+// checkExposure rejects a new policy that would leave one of the pools, the zone or the farm it touches over a limit
+func checkExposure(stub shim.ChaincodeStubInterface, Insurances ActiveInsurance, insurance AnInsurance) error {
+	limits, err := getLimits(stub)
+	if err != nil {
+		return err
+	}
+	insurance.State = "actived" //counted whatever state it is written in
+	Insurances.AllInsurance = append(Insurances.AllInsurance[:len(Insurances.AllInsurance):len(Insurances.AllInsurance)], insurance)
+	exposure, err := exposures(stub, Insurances)
+	if err != nil {
+		return err
+	}
+
+	if limits.MinCapitalBP > 0 {
+		accounts := []string{payer(insurance)}
+		for _, treaty := range insurance.Cessions {
+			accounts = append(accounts, poolAccount(treaty.Reinsurer))
+		}
+		for _, name := range accounts {
+			pool := exposure.Pools[name]
+			if pool.Exposure > 0 && pool.CapitalBP < limits.MinCapitalBP {
+				return errors.New(name + " would hold " + strconv.Itoa(pool.Capital) + " coin against " + strconv.Itoa(pool.Exposure) + " of cover, below its capital ratio")
+			}
+		}
+	}
+	farm, err := getFarm(stub, insurance.Insurant)
+	if err != nil {
+		return err
+	}
+	if limits.FarmLimit > 0 && exposure.Farms[farm.Name] > limits.FarmLimit {
+		return errors.New("Cover on " + farm.Name + " would exceed the farm limit of " + strconv.Itoa(limits.FarmLimit))
+	}
+	if limits.ZoneLimit > 0 && farm.Zone != "" && exposure.Zones[farm.Zone] > limits.ZoneLimit {
+		return errors.New("Cover in zone " + farm.Zone + " would exceed the zone limit of " + strconv.Itoa(limits.ZoneLimit))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Get Exposure - report open cover by pool, zone and farm against the limits
+// ============================================================================================================================
+func (t *SimpleChaincode) get_exposure(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	exposure, err := exposures(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
+	exposure.Limits, err = getLimits(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(exposure)
+}
+
+// ============================================================================================================================
+// Set Limits - change the solvency and concentration limits new policies are checked against, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) set_limits(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0                 1             2
+	//  'min capital bp'  'zone limit'  'farm limit'     0 turns a limit off
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start set limits")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	var values [3]int
+	for i := range values {
+		value, err := strconv.Atoi(args[i])
+		if err != nil || value < 0 {
+			return nil, errors.New("Argument " + strconv.Itoa(i+1) + " must be a non-negative numeric string")
+		}
+		values[i] = value
+	}
+
+	limits := Limits{MinCapitalBP: values[0], ZoneLimit: values[1], FarmLimit: values[2]}
+	jsonAsBytes, _ := json.Marshal(limits)
+	err := stub.PutState(LimitsStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end set limits")
+	return nil, nil
+}
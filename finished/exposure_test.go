@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateInsuranceExposure(t *testing.T) {
+	cases := []struct {
+		name     string
+		existing []AnInsurance
+		number   string
+		rate     string
+		wantErr  string
+	}{
+		{name: "fits the capital", number: "1", rate: "100"},
+		{name: "over the capital", number: "1", rate: "101", wantErr: "capital"},
+		{name: "negative number", number: "-1", rate: "1000", wantErr: "positive"},
+		{name: "negative rate", number: "1", rate: "-1000", wantErr: "positive"},
+		{name: "zero cover", number: "0", rate: "100", wantErr: "positive"},
+		{name: "active policy uses the capital", existing: []AnInsurance{{ID: "p0", Insurant: "farm1", Number: 1, Rate: 100, State: "actived"}}, number: "1", rate: "1", wantErr: "capital"},
+		{name: "pending policy uses the capital", existing: []AnInsurance{{ID: "p0", Insurant: "farm1", Number: 1, Rate: 100, State: "pending"}}, number: "1", rate: "1", wantErr: "capital"},
+		{name: "solved policy frees the capital", existing: []AnInsurance{{ID: "p0", Insurant: "farm1", Number: 1, Rate: 100, State: "solved"}}, number: "1", rate: "100"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := newFakeStub(testNow)
+			stub.caller = "ben"
+			if err := putAccount(stub, Account{Name: InsurerAccount, Balance: 100}); err != nil {
+				t.Fatal(err)
+			}
+			if err := putFarm(stub, Farm{Name: "farm1", Owner: "ben"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := putInsurances(stub, ActiveInsurance{AllInsurance: c.existing}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := new(SimpleChaincode).Invoke(stub, "create_insurance", []string{"farm1", "ben", c.number, c.rate, "actived"})
+			if c.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+type OwnerChange struct { //one entry per owner a farm has had
+	Owner string `json:"owner"` // who owned the farm
+	Until int64  `json:"until"` // ms since epoch the ownership ended
+	TxID  string `json:"tx_id"` // transaction that handed the farm on
+}
+
+// ============================================================================================================================
+// Update Farm - change a farm's address, farm owner only
+// ============================================================================================================================
+func (t *SimpleChaincode) update_farm(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1
+	//  'farm_name'  'address'
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	fmt.Println("- start update farm")
+	if len(args[1]) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+	farm, err := ownedFarm(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	farm.Address = strings.ToLower(args[1])
+
+	err = putFarm(stub, farm)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end update farm")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Transfer Farm - hand a farm to a new owner, farm owner only. Active policies paying the old owner are either
+// re-pointed to the new owner, or have to be cancelled before the farm can change hands.
+// ============================================================================================================================
+func (t *SimpleChaincode) transfer_farm(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1            2
+	//  'farm_name'  'new owner'  'repoint' | 'require_cancel'
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start transfer farm")
+	farm, err := ownedFarm(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	newOwner, err := getUser(stub, strings.ToLower(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	if newOwner.Name == farm.Owner {
+		return nil, errors.New(farm.Name + " is already owned by " + newOwner.Name)
+	}
+	mode := strings.ToLower(args[2])
+	if mode != "repoint" && mode != "require_cancel" {
+		return nil, errors.New("3rd argument must be repoint or require_cancel")
+	}
+
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range Insurances.AllInsurance {
+		if val.Insurant != farm.Name || !val.live() {
+			continue
+		}
+		if mode == "require_cancel" {
+			return nil, errors.New("Farm still has an active insurance, void it first: " + val.ID)
+		}
+		if val.Beneficiaries == farm.Owner {
+			Insurances.AllInsurance[i].Beneficiaries = newOwner.Name
+		}
+	}
+	err = putInsurances(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	farm.OwnerHistory = append(farm.OwnerHistory, OwnerChange{Owner: farm.Owner, Until: now, TxID: stub.GetTxID()})
+	farm.Owner = newOwner.Name
+
+	err = putFarm(stub, farm)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end transfer farm")
+	return nil, nil
+}
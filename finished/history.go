@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var HistoryPrefix = "_history/" //every version of a user, farm or policy lives at _history/<kind>/<key>/<timestamp>/<tx id>
+
+type Version struct { //the peer keeps no key history on this fabric, so the chaincode keeps its own append-only log
+	Kind      string          `json:"kind"`      // user farm policy
+	Key       string          `json:"key"`       // user or farm name, policy ID
+	Value     json.RawMessage `json:"value"`     // the entity as written, null once deleted
+	Deleted   bool            `json:"deleted"`   // the entity was removed in this transaction
+	TxID      string          `json:"tx_id"`     // transaction that wrote it
+	Timestamp int64           `json:"timestamp"` // ms since epoch
+	Invoker   string          `json:"invoker"`   // user who sent the transaction, "" when their certificate names nobody
+}
+
+func historyEntryKey(kind string, key string, timestamp int64, txID string) string {
+	return fmt.Sprintf("%s%s/%s/%013d/%s", HistoryPrefix, kind, key, timestamp, txID)
+}
+
+// recordVersion appends what an entity looks like after this transaction to its history, value is nil for a delete.
+// Writing the same entity twice in one transaction keeps the last write.
+func recordVersion(stub shim.ChaincodeStubInterface, kind string, key string, value []byte) error {
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	invoker, _ := callerName(stub)
+	version := Version{Kind: kind, Key: key, Deleted: value == nil, TxID: stub.GetTxID(), Timestamp: now, Invoker: invoker}
+	if value != nil {
+		version.Value = json.RawMessage(value)
+	}
+	versionAsBytes, _ := json.Marshal(version)
+	return stub.PutState(historyEntryKey(kind, key, now, version.TxID), versionAsBytes)
+}
+
+// recordPolicyVersions compares the stored policies with the ones about to be written and logs every policy that changed
+func recordPolicyVersions(stub shim.ChaincodeStubInterface, Insurances ActiveInsurance) error {
+	before, err := getInsurances(stub)
+	if err != nil {
+		return err
+	}
+	old := map[string][]byte{}
+	for _, val := range before.AllInsurance {
+		old[val.ID], _ = json.Marshal(val)
+	}
+	for _, val := range Insurances.AllInsurance {
+		valAsBytes, _ := json.Marshal(val)
+		if string(old[val.ID]) != string(valAsBytes) {
+			err = recordVersion(stub, "policy", val.ID, valAsBytes)
+			if err != nil {
+				return err
+			}
+		}
+		delete(old, val.ID)
+	}
+	for _, val := range before.AllInsurance {
+		if _, gone := old[val.ID]; gone {
+			err = recordVersion(stub, "policy", val.ID, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Get History - read every version of a user, farm or policy, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) get_history(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0                            1
+	//  'user' | 'farm' | 'policy'   'key'
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+	kind := strings.ToLower(args[0])
+	if kind != "user" && kind != "farm" && kind != "policy" {
+		return nil, errors.New("1st argument must be user, farm or policy")
+	}
+	key := args[1]
+	if kind != "policy" {
+		key = strings.ToLower(key)
+	}
+
+	prefix := HistoryPrefix + kind + "/" + key + "/"
+	iter, err := stub.RangeQueryState(prefix, prefix+KeyMax)
+	if err != nil {
+		return nil, errors.New("Failed to range over history of " + key)
+	}
+	defer iter.Close()
+
+	versions := []Version{}
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var version Version
+		json.Unmarshal(valAsbytes, &version)
+		versions = append(versions, version)
+	}
+	return json.Marshal(versions)
+}
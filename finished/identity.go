@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var RolesStr = "_roles"           //name for the key/value that will store who holds which role
+var UsernameAttr = "username"     //certificate attribute naming the invoking user
+var AdminRole = "admin"           //may register roles and manage ledger reference data
+var AssessorRole = "assessor"     //may assess claims
+var ArbitratorRole = "arbitrator" //may resolve challenged payouts
+var OracleRole = "oracle"         //may submit weather readings that are not signed by a station
+
+type Roles struct {
+	Members map[string][]string `json:"members"` // role -> user names holding it
+}
+
+// callerName is the invoking user's name, taken from their enrollment certificate
+func callerName(stub shim.ChaincodeStubInterface) (string, error) {
+	nameAsBytes, err := stub.ReadCertAttribute(UsernameAttr)
+	if err != nil || len(nameAsBytes) <= 0 {
+		return "", errors.New("Failed to read the caller's " + UsernameAttr + " attribute")
+	}
+	return strings.ToLower(string(nameAsBytes)), nil
+}
+
+func getRoles(stub shim.ChaincodeStubInterface) (Roles, error) {
+	var roles Roles
+	rolesAsBytes, err := stub.GetState(RolesStr)
+	if err != nil {
+		return roles, errors.New("Failed to get roles")
+	}
+	json.Unmarshal(rolesAsBytes, &roles)
+	if roles.Members == nil {
+		roles.Members = map[string][]string{}
+	}
+	return roles, nil
+}
+
+func (r Roles) has(role string, name string) bool {
+	for _, member := range r.Members[role] {
+		if member == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin reports whether name holds the admin role
+func isAdmin(stub shim.ChaincodeStubInterface, name string) (bool, error) {
+	roles, err := getRoles(stub)
+	if err != nil {
+		return false, err
+	}
+	return roles.has(AdminRole, name), nil
+}
+
+// requireRole returns the caller's name if they hold role, and an error otherwise
+func requireRole(stub shim.ChaincodeStubInterface, role string) (string, error) {
+	caller, err := callerName(stub)
+	if err != nil {
+		return "", err
+	}
+	roles, err := getRoles(stub)
+	if err != nil {
+		return "", err
+	}
+	if !roles.has(role, caller) {
+		return "", errors.New(caller + " is not a registered " + role)
+	}
+	return caller, nil
+}
+
+// requireOracle returns the caller's name if they may submit unsigned weather, as an oracle or an admin
+func requireOracle(stub shim.ChaincodeStubInterface) (string, error) {
+	caller, err := callerName(stub)
+	if err != nil {
+		return "", err
+	}
+	roles, err := getRoles(stub)
+	if err != nil {
+		return "", err
+	}
+	if !roles.has(OracleRole, caller) && !roles.has(AdminRole, caller) {
+		return "", errors.New(caller + " is not a registered " + OracleRole)
+	}
+	return caller, nil
+}
+
+// ============================================================================================================================
+// Register Role - grant or revoke a role, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) register_role(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1       2
+	//  'role'  'user'  'grant' | 'revoke'
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start register role")
+	if len(args[0]) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+
+	role := strings.ToLower(args[0])
+	name := strings.ToLower(args[1])
+	roles, err := getRoles(stub)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(args[2]) {
+	case "grant":
+		if !roles.has(role, name) {
+			roles.Members[role] = append(roles.Members[role], name)
+		}
+	case "revoke":
+		var kept []string
+		for _, member := range roles.Members[role] {
+			if member != name {
+				kept = append(kept, member)
+			}
+		}
+		if role == AdminRole && len(kept) == 0 {
+			return nil, errors.New("Cannot revoke the last admin")
+		}
+		roles.Members[role] = kept
+	default:
+		return nil, errors.New("3rd argument must be grant or revoke")
+	}
+
+	jsonAsBytes, _ := json.Marshal(roles)
+	err = stub.PutState(RolesStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end register role")
+	return nil, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var KeyMax = "\U0010ffff"  //sorts after any name, used as the open end of a range
+var MaxPageSize = 100      //most entries a listing returns at once
+var DescIndexStr = "_desc" //an index also lives at _desc<prefix><reversed name> so descending pages range forwards too
+
+type Page struct {
+	Items    []json.RawMessage `json:"items"`    // the entities, in the order asked for
+	Bookmark string            `json:"bookmark"` // pass back to get the next page, "" when there is none
+}
+
+// putIndex records name under prefix, the value is the name itself so a range over the prefix lists names
+func putIndex(stub shim.ChaincodeStubInterface, prefix string, name string) error {
+	err := stub.PutState(prefix+name, []byte(name))
+	if err != nil {
+		return err
+	}
+	return stub.PutState(DescIndexStr+prefix+reverseName(name), []byte(name))
+}
+
+// delIndex removes name from the index under prefix
+func delIndex(stub shim.ChaincodeStubInterface, prefix string, name string) error {
+	err := stub.DelState(prefix + name)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(DescIndexStr + prefix + reverseName(name))
+}
+
+// reverseName sorts in the opposite order to name: every byte is inverted and hex encoded, and the closing "g"
+// sorts after any hex digit so a name comes after the longer names it is a prefix of
+func reverseName(name string) string {
+	inverted := []byte(name)
+	for i := range inverted {
+		inverted[i] = 0xff - inverted[i]
+	}
+	return hex.EncodeToString(inverted) + "g"
+}
+
+// pageIndex lists up to size names under prefix after bookmark, ascending or descending, and the bookmark of the next page.
+// Both orders range forwards over their own keys and stop one past the page, the bookmark's own key is skipped
+// because the start of a range is inclusive.
+func pageIndex(stub shim.ChaincodeStubInterface, prefix string, bookmark string, size int, descending bool) ([]string, string, error) {
+	start := prefix + bookmark
+	if descending {
+		prefix = DescIndexStr + prefix
+		start = prefix
+		if bookmark != "" {
+			start += reverseName(bookmark)
+		}
+	}
+	iter, err := stub.RangeQueryState(start, prefix+KeyMax)
+	if err != nil {
+		return nil, "", errors.New("Failed to range over " + prefix)
+	}
+	defer iter.Close()
+
+	var names []string
+	for iter.HasNext() && len(names) <= size {
+		key, nameAsBytes, err := iter.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		if bookmark != "" && key == start { //the bookmark was the last entry of the previous page
+			continue
+		}
+		names = append(names, string(nameAsBytes))
+	}
+
+	next := ""
+	if len(names) > size {
+		names = names[:size]
+		next = names[size-1]
+	}
+	return names, next, nil
+}
+
+// allIndexed returns every name under prefix in ascending order, for checks that have to visit all of them
+func allIndexed(stub shim.ChaincodeStubInterface, prefix string) ([]string, error) {
+	iter, err := stub.RangeQueryState(prefix, prefix+KeyMax)
+	if err != nil {
+		return nil, errors.New("Failed to range over " + prefix)
+	}
+	defer iter.Close()
+
+	var names []string
+	for iter.HasNext() {
+		_, nameAsBytes, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, string(nameAsBytes))
+	}
+	return names, nil
+}
+
+// listIndex answers a listing query over prefix, every listed name is also the key of the entity
+func listIndex(stub shim.ChaincodeStubInterface, prefix string, args []string) ([]byte, error) {
+	//   0            1            2
+	//  'bookmark'   'page size'  'asc' | 'desc'     bookmark is "" for the first page
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+	size, err := strconv.Atoi(args[1])
+	if err != nil || size <= 0 || size > MaxPageSize {
+		return nil, errors.New("2nd argument must be a page size between 1 and " + strconv.Itoa(MaxPageSize))
+	}
+	order := strings.ToLower(args[2])
+	if order != "asc" && order != "desc" {
+		return nil, errors.New("3rd argument must be asc or desc")
+	}
+
+	names, next, err := pageIndex(stub, prefix, args[0], size, order == "desc")
+	if err != nil {
+		return nil, err
+	}
+	page := Page{Items: []json.RawMessage{}, Bookmark: next}
+	for _, name := range names {
+		valAsbytes, err := stub.GetState(name)
+		if err != nil {
+			return nil, errors.New("Failed to get " + name)
+		}
+		if valAsbytes != nil {
+			page.Items = append(page.Items, json.RawMessage(valAsbytes))
+		}
+	}
+	return json.Marshal(page)
+}
+
+// ============================================================================================================================
+// List Users - page through known users by name
+// ============================================================================================================================
+func (t *SimpleChaincode) list_users(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return listIndex(stub, UserIndexPrefix, args)
+}
+
+// ============================================================================================================================
+// List Farms - page through known farms by name
+// ============================================================================================================================
+func (t *SimpleChaincode) list_farms(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return listIndex(stub, FarmIndexPrefix, args)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPageIndex(t *testing.T) {
+	stub := newFakeStub(testNow)
+	for _, name := range []string{"b", "ab", "c", "a", "abc"} {
+		if err := putIndex(stub, UserIndexPrefix, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := putIndex(stub, FarmIndexPrefix, "a"); err != nil { //another index must not leak into the pages
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		size       int
+		descending bool
+		pages      [][]string
+	}{
+		{"ascending by two", 2, false, [][]string{{"a", "ab"}, {"abc", "b"}, {"c"}}},
+		{"descending by two", 2, true, [][]string{{"c", "b"}, {"abc", "ab"}, {"a"}}},
+		{"ascending by one", 1, false, [][]string{{"a"}, {"ab"}, {"abc"}, {"b"}, {"c"}}},
+		{"descending by one", 1, true, [][]string{{"c"}, {"b"}, {"abc"}, {"ab"}, {"a"}}},
+		{"ascending exactly full", 5, false, [][]string{{"a", "ab", "abc", "b", "c"}}},
+		{"descending exactly full", 5, true, [][]string{{"c", "b", "abc", "ab", "a"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var pages [][]string
+			bookmark := ""
+			for {
+				names, next, err := pageIndex(stub, UserIndexPrefix, bookmark, c.size, c.descending)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages = append(pages, names)
+				if next == "" {
+					break
+				}
+				if len(pages) > 10 {
+					t.Fatalf("bookmarks never ran out: %v", pages)
+				}
+				bookmark = next
+			}
+			if !reflect.DeepEqual(pages, c.pages) {
+				t.Fatalf("got pages %v, want %v", pages, c.pages)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var JournalPrefix = "_journal/" //every posting lives at _journal/<account>/<timestamp>/<tx id>/<seq> so an account's statement range-reads in time order
+
+var IssuanceAccount = "@issuance" //where minted coin comes from and burned coin goes back to
+var InsurerAccount = "@insurer"   //where payouts come from
+
+var ReasonOpening = "opening_balance" //create_user's starting coin, taken from the faucet
+var ReasonPayout = "weather_payout"   //a weather trigger paid a policy
+var ReasonClaim = "claim_payout"      //an assessed claim paid a policy
+var ReasonSweep = "close_sweep"       //a closed user's coin moved to the sweep target
+
+type Posting struct { //one side of a movement, every movement posts a debit and an equal credit
+	Account      string `json:"account"`      // user name, or a system account starting with @
+	Counterparty string `json:"counterparty"` // account on the other side
+	Debit        int    `json:"debit"`        // coin taken from Account
+	Credit       int    `json:"credit"`       // coin given to Account
+	Reason       string `json:"reason"`       // why the coin moved
+	Policy       string `json:"policy"`       // policy the movement is for, "" if none
+	TxID         string `json:"tx_id"`        // transaction that moved it
+	Timestamp    int64  `json:"timestamp"`    // ms since epoch
+}
+
+type Statement struct {
+	Account  string    `json:"account"`
+	From     string    `json:"from"`     // first day covered, "" from the beginning
+	To       string    `json:"to"`       // last day covered, "" up to now
+	Opening  int       `json:"opening"`  // balance before From
+	Closing  int       `json:"closing"`  // balance after To
+	Postings []Posting `json:"postings"` // oldest first
+}
+
+type BooksCheck struct {
+	Balanced   bool              `json:"balanced"`   // every debit has a matching credit
+	Users      int               `json:"users"`      // users checked
+	Accounts   int               `json:"accounts"`   // system accounts checked
+	Mismatches map[string][2]int `json:"mismatches"` // user or account -> [balance, journal balance] where they differ
+}
+
+// isSystemAccount reports whether an account belongs to the chaincode rather than a user
+func isSystemAccount(account string) bool {
+	return strings.HasPrefix(account, "@")
+}
+
+func postingPrefix(account string) string {
+	return JournalPrefix + account + "/"
+}
+
+// post writes one posting under the first free sequence number of this transaction for its account
+func post(stub shim.ChaincodeStubInterface, posting Posting) error {
+	base := fmt.Sprintf("%s%013d/%s/", postingPrefix(posting.Account), posting.Timestamp, posting.TxID)
+	for seq := 0; ; seq++ {
+		key := base + fmt.Sprintf("%04d", seq)
+		existing, err := stub.GetState(key)
+		if err != nil {
+			return errors.New("Failed to get posting " + key)
+		}
+		if existing == nil {
+			postingAsBytes, _ := json.Marshal(posting)
+			return stub.PutState(key, postingAsBytes)
+		}
+	}
+}
+
+// move is the only way coin changes hands. It updates the balances on both sides and journals the movement
+// as a debit of from and a credit of to. Only IssuanceAccount may be overdrawn, it is where supply comes from.
+func move(stub shim.ChaincodeStubInterface, from string, to string, amount int, reason string, policy string) error {
+	if amount < 0 {
+		return errors.New("Cannot move a negative amount")
+	}
+	if amount == 0 {
+		return nil
+	}
+	if isSystemAccount(from) {
+		account, err := getAccount(stub, from)
+		if err != nil {
+			return err
+		}
+		if from != IssuanceAccount && account.Balance < amount {
+			return errors.New(from + " has " + strconv.Itoa(account.Balance) + " coin, " + strconv.Itoa(amount) + " needed")
+		}
+		account.Balance -= amount
+		err = putAccount(stub, account)
+		if err != nil {
+			return err
+		}
+	} else {
+		user, err := getUser(stub, from)
+		if err != nil {
+			return err
+		}
+		if user.Coin < amount {
+			return errors.New(from + " has " + strconv.Itoa(user.Coin) + " coin, " + strconv.Itoa(amount) + " needed")
+		}
+		user.Coin -= amount
+		err = putUser(stub, user)
+		if err != nil {
+			return err
+		}
+	}
+	if isSystemAccount(to) {
+		account, err := getAccount(stub, to)
+		if err != nil {
+			return err
+		}
+		account.Balance += amount
+		err = putAccount(stub, account)
+		if err != nil {
+			return err
+		}
+	} else {
+		user, err := getUser(stub, to)
+		if err != nil {
+			return err
+		}
+		user.Coin += amount
+		err = putUser(stub, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	txID := stub.GetTxID()
+	err = post(stub, Posting{Account: from, Counterparty: to, Debit: amount, Reason: reason, Policy: policy, TxID: txID, Timestamp: now})
+	if err != nil {
+		return err
+	}
+	return post(stub, Posting{Account: to, Counterparty: from, Credit: amount, Reason: reason, Policy: policy, TxID: txID, Timestamp: now})
+}
+
+// readPostings returns an account's postings with timestamps in [from, to), oldest first
+func readPostings(stub shim.ChaincodeStubInterface, account string, from int64, to int64) ([]Posting, error) {
+	prefix := postingPrefix(account)
+	iter, err := stub.RangeQueryState(fmt.Sprintf("%s%013d", prefix, from), fmt.Sprintf("%s%013d", prefix, to))
+	if err != nil {
+		return nil, errors.New("Failed to range over journal of " + account)
+	}
+	defer iter.Close()
+
+	var postings []Posting
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var posting Posting
+		json.Unmarshal(valAsbytes, &posting)
+		postings = append(postings, posting)
+	}
+	return postings, nil
+}
+
+func balanceOf(postings []Posting) int {
+	balance := 0
+	for _, posting := range postings {
+		balance += posting.Credit - posting.Debit
+	}
+	return balance
+}
+
+// ============================================================================================================================
+// Get Statement - read an account's journal postings between two dates with its opening and closing balance
+// ============================================================================================================================
+func (t *SimpleChaincode) get_statement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0          1            2
+	//  'account'  'from date'  'to date'     dates are YYYY-MM-DD, both inclusive, either may be ""
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[0]) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	statement := Statement{Account: strings.ToLower(args[0]), From: args[1], To: args[2], Postings: []Posting{}}
+	var from, to int64 = 0, 9999999999999
+	var err error
+	if statement.From != "" {
+		from, err = parseDate(statement.From)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if statement.To != "" {
+		to, err = parseDate(statement.To)
+		if err != nil {
+			return nil, err
+		}
+		to += 24 * 60 * 60 * 1000
+	}
+
+	before, err := readPostings(stub, statement.Account, 0, from)
+	if err != nil {
+		return nil, err
+	}
+	statement.Opening = balanceOf(before)
+	postings, err := readPostings(stub, statement.Account, from, to)
+	if err != nil {
+		return nil, err
+	}
+	statement.Postings = append(statement.Postings, postings...)
+	statement.Closing = statement.Opening + balanceOf(postings)
+	return json.Marshal(statement)
+}
+
+// ============================================================================================================================
+// Verify Books - check the journal balances and that every user's coin and every system account's balance equals
+// the sum of its postings
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_books(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	check := BooksCheck{Mismatches: map[string][2]int{}}
+	iter, err := stub.RangeQueryState(JournalPrefix, JournalPrefix+KeyMax)
+	if err != nil {
+		return nil, errors.New("Failed to range over the journal")
+	}
+	total := 0
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		var posting Posting
+		json.Unmarshal(valAsbytes, &posting)
+		total += posting.Credit - posting.Debit
+	}
+	iter.Close()
+	check.Balanced = total == 0
+
+	names, err := allIndexed(stub, UserIndexPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		user, err := getUser(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		postings, err := readPostings(stub, user.Name, 0, 9999999999999)
+		if err != nil {
+			return nil, err
+		}
+		check.Users++
+		if journal := balanceOf(postings); journal != user.Coin {
+			check.Mismatches[user.Name] = [2]int{user.Coin, journal}
+		}
+	}
+
+	iter, err = stub.RangeQueryState(AccountPrefix, AccountPrefix+KeyMax)
+	if err != nil {
+		return nil, errors.New("Failed to range over accounts")
+	}
+	var accounts []Account
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		var account Account
+		json.Unmarshal(valAsbytes, &account)
+		accounts = append(accounts, account)
+	}
+	iter.Close()
+	for _, account := range accounts {
+		postings, err := readPostings(stub, account.Name, 0, 9999999999999)
+		if err != nil {
+			return nil, err
+		}
+		check.Accounts++
+		if journal := balanceOf(postings); journal != account.Balance {
+			check.Mismatches[account.Name] = [2]int{account.Balance, journal}
+		}
+	}
+	return json.Marshal(check)
+}
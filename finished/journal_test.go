@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// booksStub holds users ben with 50 coin and amy with none, and an insurer with 100, each opened through the journal
+func booksStub(t *testing.T) *fakeStub {
+	stub := newFakeStub(testNow)
+	for _, name := range []string{"ben", "amy"} {
+		if err := putUser(stub, User{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+		if err := putIndex(stub, UserIndexPrefix, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := move(stub, IssuanceAccount, InsurerAccount, 100, ReasonOpening, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := move(stub, IssuanceAccount, "ben", 50, ReasonOpening, ""); err != nil {
+		t.Fatal(err)
+	}
+	return stub
+}
+
+func verifyBooks(t *testing.T, stub *fakeStub) BooksCheck {
+	checkAsBytes, err := new(SimpleChaincode).verify_books(stub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var check BooksCheck
+	json.Unmarshal(checkAsBytes, &check)
+	return check
+}
+
+func TestMove(t *testing.T) {
+	cases := []struct {
+		name     string
+		from     string
+		to       string
+		amount   int
+		err      string
+		balances map[string]int // user or account -> balance after the move
+	}{
+		{"user to user", "ben", "amy", 20, "", map[string]int{"ben": 30, "amy": 20}},
+		{"user to account", "ben", InsurerAccount, 50, "", map[string]int{"ben": 0, InsurerAccount: 150}},
+		{"account to user", InsurerAccount, "amy", 100, "", map[string]int{InsurerAccount: 0, "amy": 100}},
+		{"issuance overdraws", IssuanceAccount, "amy", 10, "", map[string]int{IssuanceAccount: -160, "amy": 10}},
+		{"nothing", "ben", "amy", 0, "", map[string]int{"ben": 50, "amy": 0}},
+		{"negative", "amy", "ben", -5, "negative amount", map[string]int{"ben": 50, "amy": 0}},
+		{"user overdraws", "ben", "amy", 51, "ben has 50 coin, 51 needed", map[string]int{"ben": 50, "amy": 0}},
+		{"account overdraws", InsurerAccount, "ben", 101, "@insurer has 100 coin, 101 needed", map[string]int{InsurerAccount: 100, "ben": 50}},
+		{"unknown user", "carol", "ben", 10, "user don't exist", map[string]int{"ben": 50}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := booksStub(t)
+			err := move(stub, c.from, c.to, c.amount, ReasonPayout, "policy1")
+			if c.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+				t.Fatalf("got error %v, want %q", err, c.err)
+			}
+			for name, want := range c.balances {
+				got := 0
+				if isSystemAccount(name) {
+					account, _ := getAccount(stub, name)
+					got = account.Balance
+				} else {
+					user, _ := getUser(stub, name)
+					got = user.Coin
+				}
+				if got != want {
+					t.Fatalf("%s has %d coin, want %d", name, got, want)
+				}
+			}
+			if c.err == "" {
+				if check := verifyBooks(t, stub); !check.Balanced || len(check.Mismatches) != 0 {
+					t.Fatalf("books do not add up after the move: %+v", check)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyBooks(t *testing.T) {
+	cases := []struct {
+		name       string
+		tamper     func(stub *fakeStub)
+		balanced   bool
+		mismatches map[string][2]int
+	}{
+		{"untouched", func(stub *fakeStub) {}, true, map[string][2]int{}},
+		{"user edited", func(stub *fakeStub) {
+			putUser(stub, User{Name: "amy", Coin: 7})
+		}, true, map[string][2]int{"amy": {7, 0}}},
+		{"account edited", func(stub *fakeStub) {
+			putAccount(stub, Account{Name: InsurerAccount, Balance: 90})
+		}, true, map[string][2]int{InsurerAccount: {90, 100}}},
+		{"one sided posting", func(stub *fakeStub) {
+			post(stub, Posting{Account: "ben", Counterparty: IssuanceAccount, Credit: 5, Reason: ReasonOpening, TxID: "tx2", Timestamp: testNow})
+		}, false, map[string][2]int{"ben": {50, 55}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := booksStub(t)
+			c.tamper(stub)
+			check := verifyBooks(t, stub)
+			if check.Balanced != c.balanced || check.Users != 2 || check.Accounts != 2 {
+				t.Fatalf("got balanced %v over %d users and %d accounts, want %v over 2 and 2", check.Balanced, check.Users, check.Accounts, c.balanced)
+			}
+			if len(check.Mismatches) != len(c.mismatches) {
+				t.Fatalf("got mismatches %v, want %v", check.Mismatches, c.mismatches)
+			}
+			for name, want := range c.mismatches {
+				if check.Mismatches[name] != want {
+					t.Fatalf("got mismatches %v, want %v", check.Mismatches, c.mismatches)
+				}
+			}
+		})
+	}
+}
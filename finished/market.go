@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var ListingPrefix = "_listing/" //a policy offered for sale lives at _listing/<policy>, one listing per policy
+
+var ReasonSale = "policy_sale" //a buyer paid a seller for a policy's payout rights
+
+type Listing struct {
+	Policy    string `json:"policy"`    // ID of the policy for sale
+	Seller    string `json:"seller"`    // beneficiary when it was listed
+	Price     int    `json:"price"`     // coin asked
+	TxID      string `json:"tx_id"`     // transaction that listed it or last changed the price
+	Timestamp int64  `json:"timestamp"` // ms since epoch
+}
+
+type byPrice []Listing
+
+func (l byPrice) Len() int           { return len(l) }
+func (l byPrice) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byPrice) Less(i, j int) bool { return l[i].Price < l[j].Price }
+
+func getListing(stub shim.ChaincodeStubInterface, policy string) (Listing, error) {
+	var listing Listing
+	listingAsBytes, err := stub.GetState(ListingPrefix + policy)
+	if err != nil {
+		return listing, errors.New("Failed to get listing of " + policy)
+	}
+	json.Unmarshal(listingAsBytes, &listing)
+	if listing.Policy != policy {
+		return listing, errors.New("policy not listed")
+	}
+	return listing, nil
+}
+
+// tradable reports why a policy cannot change hands, "" when it can. Only active policies nothing has been paid on trade.
+func tradable(policy AnInsurance) string {
+	if policy.State != "actived" {
+		return "Only active insurance can be traded"
+	}
+	if policy.Paid > 0 {
+		return "Insurance has already been triggered"
+	}
+	return ""
+}
+
+// ============================================================================================================================
+// List Policy For Sale - the beneficiary offers a policy's payout rights at a price, listing again changes the price
+// ============================================================================================================================
+func (t *SimpleChaincode) list_policy_for_sale(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0         1
+	//  'policy'  'price'
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	fmt.Println("- start list policy for sale")
+	price, err := strconv.Atoi(args[1])
+	if err != nil || price <= 0 {
+		return nil, errors.New("2nd argument must be a positive numeric string")
+	}
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	i := findInsurance(Insurances, args[0])
+	if i < 0 {
+		return nil, errors.New("insurance not exist")
+	}
+	policy := Insurances.AllInsurance[i]
+	if reason := tradable(policy); reason != "" {
+		return nil, errors.New(reason)
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Beneficiaries != caller {
+		return nil, errors.New("Only the beneficiary of " + policy.ID + " can sell it")
+	}
+
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	listing := Listing{Policy: policy.ID, Seller: caller, Price: price, TxID: stub.GetTxID(), Timestamp: now}
+	listingAsBytes, _ := json.Marshal(listing)
+	err = stub.PutState(ListingPrefix+policy.ID, listingAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end list policy for sale")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Buy Policy - pay the asking price to the seller and become the policy's beneficiary in one transaction
+// ============================================================================================================================
+func (t *SimpleChaincode) buy_policy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0         1
+	//  'policy'  'price'     the price the buyer agrees to, the sale fails if the listing asks anything else
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	fmt.Println("- start buy policy")
+	price, err := strconv.Atoi(args[1])
+	if err != nil || price <= 0 {
+		return nil, errors.New("2nd argument must be a positive numeric string")
+	}
+	listing, err := getListing(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if listing.Price != price {
+		return nil, errors.New("Listing asks " + strconv.Itoa(listing.Price) + " coin")
+	}
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	i := findInsurance(Insurances, listing.Policy)
+	if i < 0 {
+		return nil, errors.New("insurance not exist")
+	}
+	if reason := tradable(Insurances.AllInsurance[i]); reason != "" {
+		return nil, errors.New(reason)
+	}
+	if Insurances.AllInsurance[i].Beneficiaries != listing.Seller {
+		return nil, errors.New("Seller is no longer the beneficiary of " + listing.Policy)
+	}
+	buyer, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	if buyer == listing.Seller {
+		return nil, errors.New("Cannot buy your own policy")
+	}
+
+	//price and policy change hands in the same transaction, so there is nothing to hold in escrow
+	err = move(stub, buyer, listing.Seller, listing.Price, ReasonSale, listing.Policy)
+	if err != nil {
+		return nil, err
+	}
+	Insurances.AllInsurance[i].Beneficiaries = buyer
+	err = putInsurances(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(ListingPrefix + listing.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end buy policy")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Delist - take a policy off the market, seller or admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) delist(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'policy'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	fmt.Println("- start delist")
+	listing, err := getListing(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := isAdmin(stub, caller)
+	if err != nil {
+		return nil, err
+	}
+	if listing.Seller != caller && !admin {
+		return nil, errors.New("Only the seller or an admin can delist " + listing.Policy)
+	}
+
+	err = stub.DelState(ListingPrefix + listing.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end delist")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get Order Book - every policy on offer that can still be bought, cheapest first
+// ============================================================================================================================
+func (t *SimpleChaincode) get_order_book(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := stub.RangeQueryState(ListingPrefix, ListingPrefix+KeyMax)
+	if err != nil {
+		return nil, errors.New("Failed to range over listings")
+	}
+	defer iter.Close()
+
+	//listings whose policy was paid, voided or passed on since are left out, buy_policy would refuse them
+	listings := []Listing{}
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var listing Listing
+		json.Unmarshal(valAsbytes, &listing)
+		i := findInsurance(Insurances, listing.Policy)
+		if i < 0 || tradable(Insurances.AllInsurance[i]) != "" || Insurances.AllInsurance[i].Beneficiaries != listing.Seller {
+			continue
+		}
+		listings = append(listings, listing)
+	}
+	sort.Stable(byPrice(listings))
+	return json.Marshal(listings)
+}
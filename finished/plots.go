@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+type Plot struct { //a bed inside a farm growing one crop
+	ID      string `json:"id"`      // unique within the farm
+	Crop    string `json:"crop"`    // crop type, e.g. lettuce
+	Planted string `json:"planted"` // planting date, YYYY-MM-DD
+	Harvest string `json:"harvest"` // harvest date, "" while the crop is still in the ground
+	Area    int    `json:"area"`    // square metres
+}
+
+// findPlot returns the position of the plot with id in the farm, or -1
+func findPlot(farm Farm, id string) int {
+	for i, plot := range farm.Plots {
+		if plot.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// growing reports whether the plot's crop is in the ground on date, from planting up to but not including harvest
+func (p Plot) growing(date string) bool {
+	return p.Planted <= date && (p.Harvest == "" || date < p.Harvest)
+}
+
+// ownedFarm reads a farm and checks that the caller owns it
+func ownedFarm(stub shim.ChaincodeStubInterface, name string) (Farm, error) {
+	farm, err := getFarm(stub, strings.ToLower(name))
+	if err != nil {
+		return farm, err
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return farm, err
+	}
+	if farm.Owner != caller {
+		return farm, errors.New("Only the owner of " + farm.Name + " can change it")
+	}
+	return farm, nil
+}
+
+// ============================================================================================================================
+// Add Plot - add a plot to a farm, farm owner only
+// ============================================================================================================================
+func (t *SimpleChaincode) add_plot(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1         2       3              4
+	//  'farm_name'  'plot'    'crop'  'planted date' 'area'
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	fmt.Println("- start add plot")
+	if len(args[1]) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return nil, errors.New("3rd argument must be a non-empty string")
+	}
+	if _, err := parseDate(args[3]); err != nil {
+		return nil, err
+	}
+	area, err := strconv.Atoi(args[4])
+	if err != nil || area <= 0 {
+		return nil, errors.New("5th argument must be a positive numeric string")
+	}
+
+	farm, err := ownedFarm(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	plot := Plot{ID: strings.ToLower(args[1]), Crop: strings.ToLower(args[2]), Planted: args[3], Area: area}
+	if findPlot(farm, plot.ID) >= 0 {
+		return nil, errors.New("This plot already exists: " + plot.ID)
+	}
+	farm.Plots = append(farm.Plots, plot)
+
+	err = putFarm(stub, farm)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end add plot")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Harvest Plot - record the day a plot's crop came out of the ground, farm owner only
+// ============================================================================================================================
+func (t *SimpleChaincode) harvest_plot(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1         2
+	//  'farm_name'  'plot'    'harvest date'
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start harvest plot")
+	if _, err := parseDate(args[2]); err != nil {
+		return nil, err
+	}
+	farm, err := ownedFarm(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	i := findPlot(farm, strings.ToLower(args[1]))
+	if i < 0 {
+		return nil, errors.New("plot not exist")
+	}
+	if args[2] < farm.Plots[i].Planted {
+		return nil, errors.New("A crop cannot be harvested before it was planted")
+	}
+	farm.Plots[i].Harvest = args[2]
+
+	err = putFarm(stub, farm)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end harvest plot")
+	return nil, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var PoolPrefix = "_pool/" //every insurer pool lives at _pool/<name>, its capital is the system account poolAccount(name)
+
+var ReasonFunding = "pool_funding" //a manager paid capital into a pool
+var ReasonCession = "cession"      //a reinsurer paid its share of a payout to the ceding pool
+
+type Treaty struct {
+	Reinsurer string `json:"reinsurer"` // pool that takes on the share
+	CedeBP    int    `json:"cede_bp"`   // share of every payout ceded, in basis points
+}
+
+type Pool struct {
+	Name     string   `json:"name"`     // pool name
+	Manager  string   `json:"manager"`  // user who underwrites for the pool and funds it
+	Treaties []Treaty `json:"treaties"` // reinsurance the pool cedes to, copied onto each policy it underwrites
+}
+
+// poolAccount is the system account holding a pool's capital
+func poolAccount(name string) string {
+	return "@pool:" + name
+}
+
+func getPool(stub shim.ChaincodeStubInterface, name string) (Pool, error) {
+	var pool Pool
+	poolAsBytes, err := stub.GetState(PoolPrefix + name)
+	if err != nil {
+		return pool, errors.New("Failed to get pool " + name)
+	}
+	json.Unmarshal(poolAsBytes, &pool)
+	if pool.Name != name {
+		return pool, errors.New("pool not exist")
+	}
+	return pool, nil
+}
+
+func putPool(stub shim.ChaincodeStubInterface, pool Pool) error {
+	poolAsBytes, _ := json.Marshal(pool)
+	return stub.PutState(PoolPrefix+pool.Name, poolAsBytes)
+}
+
+// managedPoolOf returns the name of a pool the user manages, "" if none
+func managedPoolOf(stub shim.ChaincodeStubInterface, user string) (string, error) {
+	iter, err := stub.RangeQueryState(PoolPrefix, PoolPrefix+"~")
+	if err != nil {
+		return "", errors.New("Failed to range over pools")
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		_, poolAsBytes, err := iter.Next()
+		if err != nil {
+			return "", err
+		}
+		var pool Pool
+		json.Unmarshal(poolAsBytes, &pool)
+		if pool.Manager == user {
+			return pool.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// payer is the account a policy's payouts are charged to, policies from before pools existed use InsurerAccount
+func payer(insurance AnInsurance) string {
+	if insurance.Pool == "" {
+		return InsurerAccount
+	}
+	return poolAccount(insurance.Pool)
+}
+
+// settleCessions has every reinsurer on the policy pay its share of amount to the underwriting pool, ahead of the
+// pool paying the beneficiary in full
+func settleCessions(stub shim.ChaincodeStubInterface, insurance AnInsurance, amount int) error {
+	for _, treaty := range insurance.Cessions {
+		ceded := amount * treaty.CedeBP / 10000
+		err := move(stub, poolAccount(treaty.Reinsurer), payer(insurance), ceded, ReasonCession, insurance.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Create Pool - open an insurer pool run by a manager, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) create_pool(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1
+	//  'name'  'manager'
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	fmt.Println("- start create pool")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(args[0])
+	if len(name) <= 0 || strings.Contains(name, "/") {
+		return nil, errors.New("1st argument must be a non-empty name without '/'")
+	}
+	if _, err := getPool(stub, name); err == nil {
+		return nil, errors.New("This pool already exists: " + name)
+	}
+	manager, err := getUser(stub, strings.ToLower(args[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	err = putPool(stub, Pool{Name: name, Manager: manager.Name})
+	if err != nil {
+		return nil, err
+	}
+	err = putAccount(stub, Account{Name: poolAccount(name)})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end create pool")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Fund Pool - the pool's manager pays capital into it from their own coin
+// ============================================================================================================================
+func (t *SimpleChaincode) fund_pool(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1
+	//  'pool'  'amount'
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	fmt.Println("- start fund pool")
+	pool, err := getPool(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	amount, err := strconv.Atoi(args[1])
+	if err != nil || amount <= 0 {
+		return nil, errors.New("2nd argument must be a positive numeric string")
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != pool.Manager {
+		return nil, errors.New("Only the manager of " + pool.Name + " can fund it")
+	}
+
+	err = move(stub, caller, poolAccount(pool.Name), amount, ReasonFunding, "")
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end fund pool")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Set Treaty - cede a share of a pool's future policies to a reinsurer pool, 0 bp ends the treaty, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) set_treaty(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1            2
+	//  'pool'  'reinsurer'  'cede bp'
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start set treaty")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	pool, err := getPool(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	reinsurer, err := getPool(stub, strings.ToLower(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	if reinsurer.Name == pool.Name {
+		return nil, errors.New("A pool cannot reinsure itself")
+	}
+	cede, err := strconv.Atoi(args[2])
+	if err != nil || cede < 0 || cede > 10000 {
+		return nil, errors.New("3rd argument must be basis points between 0 and 10000")
+	}
+
+	var treaties []Treaty
+	total := cede
+	for _, treaty := range pool.Treaties {
+		if treaty.Reinsurer != reinsurer.Name {
+			treaties = append(treaties, treaty)
+			total += treaty.CedeBP
+		}
+	}
+	if total > 10000 {
+		return nil, errors.New("A pool cannot cede more than all of its risk")
+	}
+	if cede > 0 {
+		treaties = append(treaties, Treaty{Reinsurer: reinsurer.Name, CedeBP: cede})
+	}
+	pool.Treaties = treaties
+
+	err = putPool(stub, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end set treaty")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Accept Insurance - a pool's manager takes on a policy proposed to the pool, its buyer's premium goes into escrow
+// ============================================================================================================================
+func (t *SimpleChaincode) accept_insurance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'policy'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	fmt.Println("- start accept insurance")
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	i := findInsurance(Insurances, args[0])
+	if i < 0 {
+		return nil, errors.New("insurance not exist")
+	}
+	policy := Insurances.AllInsurance[i]
+	if policy.State != "proposed" {
+		return nil, errors.New("Insurance " + policy.ID + " is not waiting to be accepted")
+	}
+	pool, err := managedPool(stub, policy.Pool)
+	if err != nil {
+		return nil, err
+	}
+	policy.Cessions = pool.Treaties //the treaties in force when the pool takes the risk on
+	err = checkExposure(stub, Insurances, policy)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Premium > 0 {
+		pricing, err := getPricing(stub)
+		if err != nil {
+			return nil, err
+		}
+		err = escrowPremium(stub, &policy, pricing.TermDays, []string{pool.Manager})
+		if err != nil {
+			return nil, err
+		}
+	}
+	policy.State = "actived"
+	Insurances.AllInsurance[i] = policy
+	err = putInsurances(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end accept insurance")
+	return nil, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// poolStub has farm1 owned by ben with two days of weather, a pool1 run by manager1 with 1000 coin, and oracle1
+func poolStub(t *testing.T) *fakeStub {
+	stub := newFakeStub(testNow)
+	rolesAsBytes, _ := json.Marshal(Roles{Members: map[string][]string{OracleRole: {"oracle1"}}})
+	stub.state[RolesStr] = rolesAsBytes
+	for _, user := range []User{{Name: "ben", Coin: 500}, {Name: "manager1", Coin: 500}} {
+		if err := putUser(stub, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := putFarm(stub, Farm{Name: "farm1", Owner: "ben"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putPool(stub, Pool{Name: "pool1", Manager: "manager1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putAccount(stub, Account{Name: poolAccount("pool1"), Balance: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	stub.caller = "oracle1"
+	for _, date := range []string{"2023-11-13", "2023-11-14"} {
+		if _, err := new(SimpleChaincode).Invoke(stub, "update_weather", []string{"farm1", "rainy", "10", date, "oracle1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stub
+}
+
+func TestPoolPolicyBuyerPaysOnAcceptance(t *testing.T) {
+	stub := poolStub(t)
+	farm, _ := getFarm(stub, "farm1")
+	q, err := quote(stub, farm, 3, 100, "2023-11-14")
+	if err != nil {
+		t.Fatal(err)
+	}
+	premium := strconv.Itoa(q.Premium)
+	args := []string{"farm1", "ben", "1", "100", "actived", "3", premium, "2023-11-14", "", "", "pool1"}
+
+	stub.caller = "manager1"
+	if _, err := new(SimpleChaincode).Invoke(stub, "create_insurance", args); err == nil || !strings.Contains(err.Error(), "can buy") {
+		t.Fatalf("got error %v, want the manager refused as buyer", err)
+	}
+	stub.caller = "ben"
+	if _, err := new(SimpleChaincode).Invoke(stub, "create_insurance", args); err != nil {
+		t.Fatal(err)
+	}
+	Insurances, _ := getInsurances(stub)
+	policy := Insurances.AllInsurance[0]
+	if policy.State != "proposed" || policy.Buyer != "ben" || policy.PremiumEscrow != "" {
+		t.Fatalf("got %+v, want a proposal with no premium taken", policy)
+	}
+
+	if _, err := new(SimpleChaincode).Invoke(stub, "accept_insurance", []string{policy.ID}); err == nil {
+		t.Fatal("the buyer accepted on the pool's behalf")
+	}
+	stub.caller = "manager1"
+	if _, err := new(SimpleChaincode).Invoke(stub, "accept_insurance", []string{policy.ID}); err != nil {
+		t.Fatal(err)
+	}
+	Insurances, _ = getInsurances(stub)
+	policy = Insurances.AllInsurance[0]
+	ben, _ := getUser(stub, "ben")
+	manager, _ := getUser(stub, "manager1")
+	if policy.State != "actived" || policy.PremiumEscrow == "" || ben.Coin != 500-q.Premium || manager.Coin != 500 {
+		t.Fatalf("got %+v, ben %d and manager %d coin, want ben charged the premium of %d", policy, ben.Coin, manager.Coin, q.Premium)
+	}
+	if _, err := new(SimpleChaincode).Invoke(stub, "accept_insurance", []string{policy.ID}); err == nil {
+		t.Fatal("a policy was accepted twice")
+	}
+}
+
+func TestRulePolicyCannotBePriced(t *testing.T) {
+	stub := poolStub(t)
+	stub.caller = "ben"
+	args := []string{"farm1", "ben", "1", "100", "actived", "3", "10", "2023-11-14", "", "", "pool1", `count(condition == "rainy", 3) >= 2`}
+	if _, err := new(SimpleChaincode).Invoke(stub, "create_insurance", args); err == nil || !strings.Contains(err.Error(), "cannot be priced") {
+		t.Fatalf("got error %v, want the priced rule refused", err)
+	}
+	args[6], args[7] = "", ""
+	if _, err := new(SimpleChaincode).Invoke(stub, "create_insurance", args); err != nil {
+		t.Fatal(err)
+	}
+}
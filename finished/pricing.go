@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var PricingStr = "_pricing" //name for the key/value that will store the premium pricing factors
+
+type Pricing struct { //factors are in basis points, 10000 = 100%
+	TermDays          int  `json:"term_days"`           // days of cover a premium buys
+	LoadingBP         int  `json:"loading_bp"`          // risk loading added on top of the expected loss
+	ExpenseBP         int  `json:"expense_bp"`          // expenses charged as a share of the sum insured
+	MinHistoryDays    int  `json:"min_history_days"`    // fewer observed days than this and the zone's history is used instead
+	QuoteValidityDays int  `json:"quote_validity_days"` // how long after its as-of date a quote can still be taken up
+	RequireQuote      bool `json:"require_quote"`       // create_insurance must carry a premium that matches a quote
+}
+
+type Quote struct {
+	Farm          string `json:"farm"`           // farm quoted for
+	History       string `json:"history"`        // "farm" or "zone", whose readings the estimate came from
+	Trigger       int    `json:"trigger"`        // adverse days in a row that pay out
+	SumInsured    int    `json:"sum_insured"`    // Number * Rate of the policy
+	AsOf          string `json:"as_of"`          // last day of history the quote looked at
+	HistoryDays   int    `json:"history_days"`   // observed days in that history
+	Events        int    `json:"events"`         // times the trigger would have fired
+	ProbabilityBP int    `json:"probability_bp"` // estimated chance of firing within one term
+	Premium       int    `json:"premium"`        // coin to charge
+	ValidUntil    string `json:"valid_until"`    // last day create_insurance accepts the quote
+}
+
+func defaultPricing() Pricing {
+	return Pricing{TermDays: 30, LoadingBP: 2000, ExpenseBP: 100, MinHistoryDays: 30, QuoteValidityDays: 3}
+}
+
+func getPricing(stub shim.ChaincodeStubInterface) (Pricing, error) {
+	pricing := defaultPricing()
+	pricingAsBytes, err := stub.GetState(PricingStr)
+	if err != nil {
+		return pricing, errors.New("Failed to get pricing")
+	}
+	json.Unmarshal(pricingAsBytes, &pricing)
+	return pricing, nil
+}
+
+// triggerEvents counts how often a run of trigger adverse days completes in days, a fired run has to start over
+func triggerEvents(days []Weather, trigger int) int {
+	events, run := 0, 0
+	for i, day := range days {
+		if i > 0 && day.Observed-days[i-1].Observed != int64(24*time.Hour/time.Millisecond) {
+			run = 0
+		}
+		if day.Severity != Adverse {
+			run = 0
+			continue
+		}
+		run++
+		if run >= trigger {
+			events++
+			run = 0
+		}
+	}
+	return events
+}
+
+// quote prices a policy from the stored weather up to asOf. It only reads the ledger, so create_insurance
+// can recompute it and check a premium against it without the quote ever being stored.
+func quote(stub shim.ChaincodeStubInterface, farm Farm, trigger int, sumInsured int, asOf string) (Quote, error) {
+	q := Quote{Farm: farm.Name, History: "farm", Trigger: trigger, SumInsured: sumInsured, AsOf: asOf}
+	if trigger <= 0 || trigger > WeatherWindow {
+		return q, errors.New("Trigger must be between 1 and " + strconv.Itoa(WeatherWindow) + " days")
+	}
+	if sumInsured <= 0 {
+		return q, errors.New("Sum insured must be positive")
+	}
+	asOfMs, err := parseDate(asOf)
+	if err != nil {
+		return q, err
+	}
+	pricing, err := getPricing(stub)
+	if err != nil {
+		return q, err
+	}
+
+	readings, err := getWeatherRange(stub, WeatherPrefix, farm.Name, "", asOf)
+	if err != nil {
+		return q, err
+	}
+	days := mergeDays(readings)
+	if len(days) < pricing.MinHistoryDays && farm.Zone != "" {
+		readings, err = getWeatherRange(stub, ZoneWeatherPrefix, farm.Zone, "", asOf)
+		if err != nil {
+			return q, err
+		}
+		if zoneDays := mergeDays(readings); len(zoneDays) > len(days) {
+			days = zoneDays
+			q.History = "zone"
+		}
+	}
+	if len(days) <= 0 {
+		return q, errors.New("No weather history to price " + farm.Name + " from")
+	}
+
+	q.HistoryDays = len(days)
+	q.Events = triggerEvents(days, trigger)
+	q.ProbabilityBP = q.Events * pricing.TermDays * 10000 / q.HistoryDays
+	if q.ProbabilityBP > 10000 {
+		q.ProbabilityBP = 10000
+	}
+	expected := sumInsured * q.ProbabilityBP / 10000
+	q.Premium = expected + expected*pricing.LoadingBP/10000 + sumInsured*pricing.ExpenseBP/10000
+	q.ValidUntil = time.Unix(0, asOfMs*int64(time.Millisecond)).UTC().AddDate(0, 0, pricing.QuoteValidityDays).Format(DateLayout)
+	return q, nil
+}
+
+// checkQuote makes sure a premium is what quote gives at asOf and that the quote has not expired
+func checkQuote(stub shim.ChaincodeStubInterface, insurance AnInsurance, asOf string) error {
+	farm, err := getFarm(stub, insurance.Insurant)
+	if err != nil {
+		return err
+	}
+	q, err := quote(stub, farm, insurance.Trigger, insurance.Number*insurance.Rate, asOf)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	today := time.Unix(0, now*int64(time.Millisecond)).UTC().Format(DateLayout)
+	if asOf > today { //a quote as of a future day would never expire
+		return errors.New("Quote as of " + asOf + " is later than today " + today)
+	}
+	if today > q.ValidUntil {
+		return errors.New("Quote as of " + asOf + " expired on " + q.ValidUntil)
+	}
+	if insurance.Premium != q.Premium {
+		return errors.New("Premium " + strconv.Itoa(insurance.Premium) + " does not match the quoted " + strconv.Itoa(q.Premium))
+	}
+	return nil
+}
+
+// escrowPremium takes a policy's premium from its buyer and holds it for the account that underwrites the policy until
+// termDays from now, when it has been earned. refunders may hand it back before then.
+func escrowPremium(stub shim.ChaincodeStubInterface, insurance *AnInsurance, termDays int, refunders []string) error {
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	conditions := EscrowConditions{ReleaseAfter: now + int64(termDays)*RuleDay, Refunders: refunders}
+	escrow, err := openEscrow(stub, insurance.Buyer, payer(*insurance), insurance.Premium, ReasonPremium, insurance.ID, conditions)
+	if err != nil {
+		return err
+	}
+	insurance.PremiumEscrow = escrow.ID
+	return nil
+}
+
+// ============================================================================================================================
+// Quote Insurance - price a policy from the farm's weather history, or its zone's when the farm's is too short
+// ============================================================================================================================
+func (t *SimpleChaincode) quote_insurance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1          2              3
+	//  'farm_name'  'trigger'  'sum insured'  'as of date'     trigger is adverse days in a row, as of may be "" for the farm's last reading
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+	farm, err := getFarm(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	trigger, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("2nd argument must be a numeric string")
+	}
+	sumInsured, err := strconv.Atoi(args[2])
+	if err != nil {
+		return nil, errors.New("3rd argument must be a numeric string")
+	}
+	asOf := args[3]
+	if asOf == "" {
+		asOf = farm.Summary.LastDate
+	}
+
+	q, err := quote(stub, farm, trigger, sumInsured, asOf)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(q)
+}
+
+// ============================================================================================================================
+// Set Pricing - change the premium pricing factors, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) set_pricing(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0           1            2            3                 4                     5
+	//  'term days' 'loading bp' 'expense bp' 'min history days' 'quote validity days' 'require quote'
+	if len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+	}
+
+	fmt.Println("- start set pricing")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	var values [5]int
+	for i := range values {
+		value, err := strconv.Atoi(args[i])
+		if err != nil || value < 0 {
+			return nil, errors.New("Argument " + strconv.Itoa(i+1) + " must be a non-negative numeric string")
+		}
+		values[i] = value
+	}
+	if values[0] <= 0 {
+		return nil, errors.New("1st argument must be at least one day")
+	}
+	requireQuote, err := strconv.ParseBool(args[5])
+	if err != nil {
+		return nil, errors.New("6th argument must be true or false")
+	}
+
+	pricing := Pricing{TermDays: values[0], LoadingBP: values[1], ExpenseBP: values[2], MinHistoryDays: values[3], QuoteValidityDays: values[4], RequireQuote: requireQuote}
+	jsonAsBytes, _ := json.Marshal(pricing)
+	err = stub.PutState(PricingStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end set pricing")
+	return nil, nil
+}
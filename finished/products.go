@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var ProductPrefix = "_product/"               //the current version of every product lives at _product/<id>
+var ProductVersionPrefix = "_productversion/" //every version ever defined lives at _productversion/<id>/<version>
+
+type Product struct { //an insurance an admin offers, policies copy what they need from it so new versions never change them
+	ID        string   `json:"id"`         // product name
+	Version   int      `json:"version"`    // 1 for the first definition, one more for every change
+	Name      string   `json:"name"`       // display name
+	Rule      string   `json:"rule"`       // trigger rule text, "" pays on AdverseStreakTrigger adverse days in a row
+	PremiumBP int      `json:"premium_bp"` // premium as a share of the amount insured, escrowed until the term is over
+	Crops     []string `json:"crops"`      // a farm must grow one of these, any when empty
+	Zones     []string `json:"zones"`      // a farm must be in one of these, any when empty
+	TermDays  int      `json:"term_days"`  // days of cover from the policy's creation
+	Schedule  []int    `json:"schedule"`   // share of the amount paid each time the rule fires, the last share repeats
+	Pool      string   `json:"pool"`       // pool that underwrites it, "" for InsurerAccount
+	Defined   int64    `json:"defined"`    // ms since epoch this version was defined
+	By        string   `json:"by"`         // admin who defined this version
+}
+
+func productVersionKey(id string, version int) string {
+	return fmt.Sprintf("%s%s/%06d", ProductVersionPrefix, id, version)
+}
+
+func getProduct(stub shim.ChaincodeStubInterface, id string) (Product, error) {
+	var product Product
+	productAsBytes, err := stub.GetState(ProductPrefix + id)
+	if err != nil {
+		return product, errors.New("Failed to get product " + id)
+	}
+	json.Unmarshal(productAsBytes, &product)
+	if product.ID != id {
+		return product, errors.New("product not exist")
+	}
+	return product, nil
+}
+
+// splitList reads a comma separated argument, "" is the empty list
+func splitList(arg string) []string {
+	var items []string
+	for _, item := range strings.Split(arg, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// scheduledAmount is what a policy pays the next time its rule fires
+func scheduledAmount(insurance AnInsurance) int {
+	cover := insurance.Number * insurance.Rate
+	if len(insurance.Schedule) == 0 {
+		return cover
+	}
+	i := insurance.Installments
+	if i >= len(insurance.Schedule) {
+		i = len(insurance.Schedule) - 1
+	}
+	return cover * insurance.Schedule[i] / 10000
+}
+
+// insureProduct is create_insurance for a product, everything but the farm, beneficiary and amount comes from the
+// product's current version. The beneficiary or the farm's owner buys it and pays its premium. A product for some
+// crops covers the farm's first plot still growing one of them.
+func insureProduct(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0          1       2             3
+	//  'product'  'farm'  'beneficial'  'amount'
+	fmt.Println("- start create insurance from product")
+	product, err := getProduct(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	farm, err := getFarm(stub, strings.ToLower(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	beneficiary, err := getUser(stub, strings.ToLower(args[2]))
+	if err != nil {
+		return nil, err
+	}
+	amount, err := strconv.Atoi(args[3])
+	if err != nil || amount <= 0 {
+		return nil, errors.New("4th argument must be a positive numeric string")
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != beneficiary.Name && caller != farm.Owner {
+		return nil, errors.New("Only " + beneficiary.Name + " or the owner of " + farm.Name + " can buy this policy")
+	}
+	if len(product.Zones) > 0 && !listed(product.Zones, farm.Zone) {
+		return nil, errors.New("Product " + product.ID + " is not offered in zone " + farm.Zone)
+	}
+	plot := ""
+	if len(product.Crops) > 0 { //the policy covers the first plot growing one of the crops, so its season applies
+		for _, candidate := range farm.Plots {
+			if plot == "" && candidate.Harvest == "" && listed(product.Crops, candidate.Crop) {
+				plot = candidate.ID
+			}
+		}
+		if plot == "" {
+			return nil, errors.New("Farm " + farm.Name + " grows none of the crops " + product.ID + " covers")
+		}
+	}
+
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	policy := AnInsurance{ID: stub.GetTxID(), Insurant: farm.Name, Beneficiaries: beneficiary.Name, Timestamp: now, Number: 1, Rate: amount, State: "actived", Trigger: AdverseStreakTrigger}
+	policy.Buyer = caller
+	policy.Plot = plot
+	policy.Product = product.ID
+	policy.ProductVersion = product.Version
+	policy.Rule = product.Rule
+	policy.Schedule = product.Schedule
+	policy.Premium = amount * product.PremiumBP / 10000
+	if product.TermDays > 0 {
+		policy.Expires = now + int64(product.TermDays)*RuleDay
+	}
+	var refunders []string
+	if product.Pool != "" {
+		pool, err := getPool(stub, product.Pool)
+		if err != nil {
+			return nil, err
+		}
+		policy.Pool = pool.Name
+		policy.Cessions = pool.Treaties
+		refunders = []string{pool.Manager}
+	}
+
+	Insurances, err := getInsurances(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkExposure(stub, Insurances, policy)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Premium > 0 {
+		escrow, err := openEscrow(stub, caller, payer(policy), policy.Premium, ReasonPremium, policy.ID, EscrowConditions{ReleaseAfter: policy.Expires, Refunders: refunders})
+		if err != nil {
+			return nil, err
+		}
+		policy.PremiumEscrow = escrow.ID
+	}
+	Insurances.AllInsurance = append(Insurances.AllInsurance, policy)
+	err = putInsurances(stub, Insurances)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end create insurance from product")
+	return []byte(policy.ID), nil
+}
+
+// ============================================================================================================================
+// Define Product - add a product or a new version of one, admin only. Policies keep the version they were written on.
+// ============================================================================================================================
+func (t *SimpleChaincode) define_product(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0     1       2       3             4        5        6            7           8
+	//  'id'  'name'  'rule'  'premium bp'  'crops'  'zones'  'term days'  'schedule'  'pool'     crops, zones and schedule are comma separated,
+	//                                                                                            schedule is basis points per payout, rule, crops, zones, schedule and pool may be ""
+	if len(args) != 9 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 9")
+	}
+
+	fmt.Println("- start define product")
+	admin, err := requireRole(stub, AdminRole)
+	if err != nil {
+		return nil, err
+	}
+	id := strings.ToLower(args[0])
+	if len(id) <= 0 || strings.Contains(id, "/") {
+		return nil, errors.New("1st argument must be a non-empty name without '/'")
+	}
+	if len(args[1]) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+	if args[2] != "" {
+		if _, err = compileRule(args[2]); err != nil {
+			return nil, errors.New("3rd argument is not a valid rule: " + err.Error())
+		}
+	}
+	premium, err := strconv.Atoi(args[3])
+	if err != nil || premium < 0 || premium > 10000 {
+		return nil, errors.New("4th argument must be basis points between 0 and 10000")
+	}
+	term, err := strconv.Atoi(args[6])
+	if err != nil || term < 0 {
+		return nil, errors.New("7th argument must be a non-negative numeric string")
+	}
+	var schedule []int
+	for _, item := range splitList(args[7]) {
+		share, err := strconv.Atoi(item)
+		if err != nil || share <= 0 || share > 10000 {
+			return nil, errors.New("8th argument must list basis points between 1 and 10000")
+		}
+		schedule = append(schedule, share)
+	}
+	pool := strings.ToLower(args[8])
+	if pool != "" {
+		if _, err = getPool(stub, pool); err != nil {
+			return nil, err
+		}
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	product := Product{ID: id, Version: 1, Name: args[1], Rule: args[2], PremiumBP: premium, Crops: splitList(args[4]), Zones: splitList(args[5]), TermDays: term, Schedule: schedule, Pool: pool, Defined: now, By: admin}
+	if current, err := getProduct(stub, id); err == nil {
+		product.Version = current.Version + 1
+	}
+	productAsBytes, _ := json.Marshal(product)
+	err = stub.PutState(productVersionKey(id, product.Version), productAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(ProductPrefix+id, productAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end define product")
+	return []byte(strconv.Itoa(product.Version)), nil
+}
+
+// ============================================================================================================================
+// Get Product - read the current version of a product, or an older one
+// ============================================================================================================================
+func (t *SimpleChaincode) get_product(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0     1
+	//  'id'  ['version']
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	id := strings.ToLower(args[0])
+	if len(args) == 1 {
+		product, err := getProduct(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(product)
+	}
+	version, err := strconv.Atoi(args[1])
+	if err != nil || version <= 0 {
+		return nil, errors.New("2nd argument must be a positive numeric string")
+	}
+	productAsBytes, err := stub.GetState(productVersionKey(id, version))
+	if err != nil {
+		return nil, errors.New("Failed to get product " + id)
+	}
+	if productAsBytes == nil {
+		return nil, errors.New("product version not exist")
+	}
+	return productAsBytes, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestInsureProductPlot(t *testing.T) {
+	cases := []struct {
+		name     string
+		crops    string
+		wantPlot string
+		wantErr  bool
+	}{
+		{name: "any crop", crops: "", wantPlot: ""},
+		{name: "growing crop", crops: "maize", wantPlot: "p3"},
+		{name: "first of several crops", crops: "wheat,lettuce", wantPlot: "p1"},
+		{name: "only harvested", crops: "beans", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := newFakeStub(testNow)
+			rolesAsBytes, _ := json.Marshal(Roles{Members: map[string][]string{AdminRole: {"alice"}}})
+			stub.state[RolesStr] = rolesAsBytes
+			if err := putAccount(stub, Account{Name: InsurerAccount, Balance: 1000}); err != nil {
+				t.Fatal(err)
+			}
+			if err := putUser(stub, User{Name: "ben"}); err != nil {
+				t.Fatal(err)
+			}
+			plots := []Plot{{ID: "p1", Crop: "lettuce"}, {ID: "p2", Crop: "maize", Harvest: "2023-10-01"}, {ID: "p3", Crop: "maize"}, {ID: "p4", Crop: "beans", Harvest: "2023-10-01"}}
+			if err := putFarm(stub, Farm{Name: "farm1", Owner: "ben", Plots: plots}); err != nil {
+				t.Fatal(err)
+			}
+			stub.caller = "alice"
+			if _, err := new(SimpleChaincode).Invoke(stub, "define_product", []string{"cover", "Cover", "", "0", c.crops, "", "30", "", ""}); err != nil {
+				t.Fatal(err)
+			}
+
+			stub.caller = "ben"
+			_, err := new(SimpleChaincode).Invoke(stub, "create_insurance", []string{"cover", "farm1", "ben", "100"})
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("a product was bought for a farm growing none of its crops")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			Insurances, _ := getInsurances(stub)
+			if got := Insurances.AllInsurance[0].Plot; got != c.wantPlot {
+				t.Fatalf("got plot %q, want %q", got, c.wantPlot)
+			}
+		})
+	}
+}
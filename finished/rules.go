@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/tomssy/farmbot_arduOS_mod/finished/trigger"
+)
+
+// Trigger rules are written in the language of the trigger package, for example
+//
+//	consecutive(condition == "rainy") >= 3 && min(temperature, 3d) < 5
+//
+// Aggregates read the fields of the farm's weather in RuleFields, and a window spans at most the WeatherWindow
+// readings, or days, a farm keeps in view.
+
+var RuleFields = map[string]trigger.Kind{"temperature": trigger.KindNumber, "condition": trigger.KindString, "severity": trigger.KindString}
+var RuleDay = trigger.Day
+
+type RuleCheck struct {
+	Rule     string `json:"rule"`
+	Valid    bool   `json:"valid"`
+	Error    string `json:"error"`    // "" when valid
+	Position int    `json:"position"` // column of the error, 0 when valid
+}
+
+// compileRule parses and type checks rule text into a condition the evaluator can run
+func compileRule(text string) (trigger.Expr, error) {
+	return trigger.Compile(text, RuleFields, WeatherWindow)
+}
+
+// policyRule is the rule a policy pays out on, its own rule text or streak adverse days in a row
+func policyRule(insurance AnInsurance, streak int) (trigger.Expr, error) {
+	if insurance.Rule == "" {
+		return streakRule(streak), nil
+	}
+	return compileRule(insurance.Rule)
+}
+
+// ============================================================================================================================
+// Validate Rule - parse and type check trigger rule text and report where it is wrong
+// ============================================================================================================================
+func (t *SimpleChaincode) validate_rule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'rule'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	check := RuleCheck{Rule: args[0], Valid: true}
+	if _, err := compileRule(args[0]); err != nil {
+		check.Valid = false
+		check.Error = err.Error()
+		if ruleErr, ok := err.(trigger.Error); ok {
+			check.Error = ruleErr.Message
+			check.Position = ruleErr.Position
+		}
+	}
+	return json.Marshal(check)
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var StationPrefix = "_station/"               //every weather station lives at _station/<id> and lists the farms linked to it
+var StationWeatherPrefix = "_stationweather/" //a station's own readings, laid out like WeatherPrefix with the station as source
+var StationMaxKm = 100.0                      //furthest a farm may be linked to a station
+var EarthRadiusKm = 6371.0
+
+var ReportMaxAge = int64(60 * 60 * 1000) //ms a signed report may take to reach the ledger
+var ReportMaxSkew = int64(5 * 60 * 1000) //ms a station's clock may run ahead of the transaction
+
+var AlgECDSA = "ecdsa-p256" //ASN.1 DER signature over the SHA-256 of the report
+var AlgEd25519 = "ed25519"  //plain Ed25519 signature over the report
+
+type Station struct {
+	ID         string   `json:"id"`         // station name, used as the source of its readings
+	Owner      string   `json:"owner"`      // user who runs it
+	Algorithm  string   `json:"algorithm"`  // AlgECDSA or AlgEd25519
+	PublicKey  string   `json:"public_key"` // base64 PKIX DER of the key its reports are signed with
+	Latitude   float64  `json:"latitude"`   // decimal degrees, north positive
+	Longitude  float64  `json:"longitude"`  // decimal degrees, east positive
+	Status     string   `json:"status"`     // active decommissioned, a decommissioned station's readings are refused
+	Calibrated string   `json:"calibrated"` // day the station was last calibrated, YYYY-MM-DD
+	Farms      []string `json:"farms"`      // farms linked to it, its readings fan out to them
+}
+
+type StationLink struct {
+	Station string  `json:"station"` // linked station
+	MaxKm   float64 `json:"max_km"`  // furthest the farm may be from the station, moving further drops the link
+	Km      float64 `json:"km"`      // distance when linked or last moved
+}
+
+type Report struct { //what a station signs, the exact bytes are passed to update_weather or update_weather_station
+	Station     string `json:"station"`     // station that measured it
+	Farm        string `json:"farm"`        // farm it is for, "" when sent to update_weather_station
+	Weather     string `json:"weather"`     // weather type
+	Temperature int    `json:"temperature"` // C
+	Date        string `json:"date"`        // day observed, YYYY-MM-DD
+	Issued      int64  `json:"issued"`      // ms since epoch the station signed it
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func getStation(stub shim.ChaincodeStubInterface, id string) (Station, error) {
+	var station Station
+	stationAsBytes, err := stub.GetState(StationPrefix + id)
+	if err != nil {
+		return station, errors.New("Failed to get station " + id)
+	}
+	json.Unmarshal(stationAsBytes, &station)
+	if station.ID != id {
+		return station, errors.New("station not exist")
+	}
+	return station, nil
+}
+
+func putStation(stub shim.ChaincodeStubInterface, station Station) error {
+	stationAsBytes, _ := json.Marshal(station)
+	return stub.PutState(StationPrefix+station.ID, stationAsBytes)
+}
+
+// parseStationKey decodes a base64 PKIX DER public key and checks it is of the algorithm's kind
+func parseStationKey(algorithm string, encoded string) (interface{}, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("Public key must be base64")
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.New("Public key must be PKIX DER")
+	}
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		if algorithm == AlgECDSA && pub.Curve == elliptic.P256() {
+			return pub, nil
+		}
+	case ed25519.PublicKey:
+		if algorithm == AlgEd25519 {
+			return pub, nil
+		}
+	}
+	return nil, errors.New("Public key is not an " + algorithm + " key")
+}
+
+// verifyReport checks a base64 signature over payload against the station's registered key
+func verifyReport(station Station, payload []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("Signature must be base64")
+	}
+	key, err := parseStationKey(station.Algorithm, station.PublicKey)
+	if err != nil {
+		return err
+	}
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		var rs ecdsaSignature
+		if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) > 0 || rs.R == nil || rs.S == nil {
+			return errors.New("Signature is not ASN.1 DER")
+		}
+		digest := sha256.Sum256(payload)
+		if ecdsa.Verify(pub, digest[:], rs.R, rs.S) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(pub, payload, sig) {
+			return nil
+		}
+	}
+	return errors.New("Report signature does not match station " + station.ID)
+}
+
+// signedReport verifies a signed report, that it is fresh and that its station is still in service
+func signedReport(stub shim.ChaincodeStubInterface, payload string, signature string) (Report, Station, error) {
+	var report Report
+	var station Station
+	if err := json.Unmarshal([]byte(payload), &report); err != nil {
+		return report, station, errors.New("Report must be JSON")
+	}
+	station, err := activeStation(stub, strings.ToLower(report.Station))
+	if err != nil {
+		return report, station, err
+	}
+	err = verifyReport(station, []byte(payload), signature)
+	if err != nil {
+		return report, station, err
+	}
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return report, station, err
+	}
+	if report.Issued < now-ReportMaxAge || report.Issued > now+ReportMaxSkew {
+		return report, station, errors.New("Report from " + station.ID + " is not fresh")
+	}
+	return report, station, nil
+}
+
+// signedReportArgs verifies a signed report for a farm linked to its station and returns it as update_weather's
+// plain arguments, with the station as the source
+func signedReportArgs(stub shim.ChaincodeStubInterface, payload string, signature string) ([]string, error) {
+	report, station, err := signedReport(stub, payload, signature)
+	if err != nil {
+		return nil, err
+	}
+	if !listed(station.Farms, strings.ToLower(report.Farm)) { //links are dropped once a farm moves out of range
+		return nil, errors.New("Station " + station.ID + " is not linked to farm " + report.Farm)
+	}
+	return []string{report.Farm, report.Weather, strconv.Itoa(report.Temperature), report.Date, station.ID}, nil
+}
+
+// checkUnsignedSource makes sure an unsigned reading comes from an oracle and does not pose as a station, or as the
+// @zone tag of a zone's fan-out, so only a station's signature can put its name on a reading
+func checkUnsignedSource(stub shim.ChaincodeStubInterface, source string) error {
+	if _, err := requireOracle(stub); err != nil {
+		return err
+	}
+	if strings.Contains(source, "@") {
+		return errors.New("Unsigned sources cannot contain '@'")
+	}
+	stationAsBytes, err := stub.GetState(StationPrefix + source)
+	if err != nil {
+		return errors.New("Failed to get station " + source)
+	}
+	if stationAsBytes != nil {
+		return errors.New("Readings from station " + source + " must be signed")
+	}
+	return nil
+}
+
+// activeStation returns the station unless it has been decommissioned
+func activeStation(stub shim.ChaincodeStubInterface, id string) (Station, error) {
+	station, err := getStation(stub, id)
+	if err != nil {
+		return station, err
+	}
+	if station.Status == "decommissioned" {
+		return station, errors.New("Station " + station.ID + " is decommissioned")
+	}
+	return station, nil
+}
+
+// distanceKm is the great-circle distance between two coordinates
+func distanceKm(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// unlinkStation takes a farm out of a station's farm list, the caller drops the link from the farm
+func unlinkStation(stub shim.ChaincodeStubInterface, id string, farm string) error {
+	station, err := getStation(stub, id)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, name := range station.Farms {
+		if name != farm {
+			kept = append(kept, name)
+		}
+	}
+	station.Farms = kept
+	return putStation(stub, station)
+}
+
+// relinkStations refreshes the distance of a farm's station links after it moved and drops those now out of range
+func relinkStations(stub shim.ChaincodeStubInterface, farm *Farm) error {
+	var kept []StationLink
+	for _, link := range farm.Stations {
+		station, err := getStation(stub, link.Station)
+		if err != nil {
+			return err
+		}
+		link.Km = distanceKm(farm.Latitude, farm.Longitude, station.Latitude, station.Longitude)
+		if link.Km <= link.MaxKm {
+			kept = append(kept, link)
+			continue
+		}
+		err = unlinkStation(stub, station.ID, farm.Name)
+		if err != nil {
+			return err
+		}
+	}
+	farm.Stations = kept
+	return nil
+}
+
+// parseCoordinate reads a latitude and longitude in decimal degrees
+func parseCoordinate(lat string, lon string) (float64, float64, error) {
+	latitude, err := strconv.ParseFloat(lat, 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		return 0, 0, errors.New("Latitude must be between -90 and 90")
+	}
+	longitude, err := strconv.ParseFloat(lon, 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		return 0, 0, errors.New("Longitude must be between -180 and 180")
+	}
+	return latitude, longitude, nil
+}
+
+// ============================================================================================================================
+// Register Station - record a weather station, where it is and the key its reports are signed with, admin only.
+// Registering an active station again moves it or rotates its key and keeps its linked farms.
+// ============================================================================================================================
+func (t *SimpleChaincode) register_station(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0     1        2                          3              4           5            6
+	//  'id'  'owner'  'ecdsa-p256' | 'ed25519'   'public key'   'latitude'  'longitude'  'calibrated date'     public key is base64 PKIX DER
+	if len(args) != 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 7")
+	}
+
+	fmt.Println("- start register station")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	id := strings.ToLower(args[0])
+	if len(id) <= 0 || strings.Contains(id, "/") || strings.Contains(id, "@") {
+		return nil, errors.New("1st argument must be a non-empty name without '/' or '@'")
+	}
+	owner, err := getUser(stub, strings.ToLower(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	algorithm := strings.ToLower(args[2])
+	if algorithm != AlgECDSA && algorithm != AlgEd25519 {
+		return nil, errors.New("3rd argument must be " + AlgECDSA + " or " + AlgEd25519)
+	}
+	if _, err = parseStationKey(algorithm, args[3]); err != nil {
+		return nil, err
+	}
+	latitude, longitude, err := parseCoordinate(args[4], args[5])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = parseDate(args[6]); err != nil {
+		return nil, err
+	}
+
+	station, err := getStation(stub, id)
+	if err == nil && station.Status == "decommissioned" {
+		return nil, errors.New("Station " + id + " is decommissioned")
+	}
+	station = Station{ID: id, Owner: owner.Name, Algorithm: algorithm, PublicKey: args[3], Latitude: latitude, Longitude: longitude, Status: "active", Calibrated: args[6], Farms: station.Farms}
+	err = putStation(stub, station)
+	if err != nil {
+		return nil, err
+	}
+	//a moved station drops the farms now out of range
+	for _, name := range station.Farms {
+		farm, err := getFarm(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		err = relinkStations(stub, &farm)
+		if err != nil {
+			return nil, err
+		}
+		err = putFarm(stub, farm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("- end register station")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Update Station - record a calibration or decommission a station, station owner or admin. Decommissioning is final.
+// ============================================================================================================================
+func (t *SimpleChaincode) update_station(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0     1                            2
+	//  'id'  'active' | 'decommissioned'  'calibrated date'     calibrated date may be "" to keep the last one
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start update station")
+	station, err := activeStation(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := isAdmin(stub, caller)
+	if err != nil {
+		return nil, err
+	}
+	if station.Owner != caller && !admin {
+		return nil, errors.New("Only the owner of " + station.ID + " or an admin can update it")
+	}
+	status := strings.ToLower(args[1])
+	if status != "active" && status != "decommissioned" {
+		return nil, errors.New("2nd argument must be active or decommissioned")
+	}
+	if args[2] != "" {
+		if _, err = parseDate(args[2]); err != nil {
+			return nil, err
+		}
+		station.Calibrated = args[2]
+	}
+
+	//a decommissioned station leaves every farm it was linked to
+	if status == "decommissioned" {
+		for _, name := range station.Farms {
+			farm, err := getFarm(stub, name)
+			if err != nil {
+				return nil, err
+			}
+			var kept []StationLink
+			for _, link := range farm.Stations {
+				if link.Station != station.ID {
+					kept = append(kept, link)
+				}
+			}
+			farm.Stations = kept
+			err = putFarm(stub, farm)
+			if err != nil {
+				return nil, err
+			}
+		}
+		station.Farms = nil
+	}
+	station.Status = status
+	err = putStation(stub, station)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end update station")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Link Station - take a station's readings for a located farm when it is within max km, farm owner only, not while the farm is insured
+// ============================================================================================================================
+func (t *SimpleChaincode) link_station(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1          2
+	//  'farm_name'  'station'  'max km'
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start link station")
+	farm, err := ownedFarm(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = requireUninsured(stub, farm.Name) //the insured must not pick whose weather triggers the cover
+	if err != nil {
+		return nil, err
+	}
+	if farm.Zone == "" {
+		return nil, errors.New("Farm " + farm.Name + " has no location yet")
+	}
+	station, err := activeStation(stub, strings.ToLower(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	maxKm, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || maxKm <= 0 || maxKm > StationMaxKm {
+		return nil, errors.New("3rd argument must be a distance between 0 and " + strconv.FormatFloat(StationMaxKm, 'f', -1, 64) + " km")
+	}
+	for _, link := range farm.Stations {
+		if link.Station == station.ID {
+			return nil, errors.New("Farm is already linked to " + station.ID)
+		}
+	}
+	km := distanceKm(farm.Latitude, farm.Longitude, station.Latitude, station.Longitude)
+	if km > maxKm {
+		return nil, errors.New("Station " + station.ID + " is " + strconv.FormatFloat(km, 'f', 1, 64) + " km away")
+	}
+
+	farm.Stations = append(farm.Stations, StationLink{Station: station.ID, MaxKm: maxKm, Km: km})
+	err = putFarm(stub, farm)
+	if err != nil {
+		return nil, err
+	}
+	station.Farms = append(station.Farms, farm.Name)
+	err = putStation(stub, station)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end link station")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Unlink Station - stop taking a station's readings, farm owner only, not while the farm is insured
+// ============================================================================================================================
+func (t *SimpleChaincode) unlink_station(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1
+	//  'farm_name'  'station'
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	fmt.Println("- start unlink station")
+	farm, err := ownedFarm(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = requireUninsured(stub, farm.Name)
+	if err != nil {
+		return nil, err
+	}
+	id := strings.ToLower(args[1])
+	var kept []StationLink
+	for _, link := range farm.Stations {
+		if link.Station != id {
+			kept = append(kept, link)
+		}
+	}
+	if len(kept) == len(farm.Stations) {
+		return nil, errors.New("Farm is not linked to " + id)
+	}
+	farm.Stations = kept
+	err = putFarm(stub, farm)
+	if err != nil {
+		return nil, err
+	}
+	err = unlinkStation(stub, id, farm.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end unlink station")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Update Weather Station - record one observation of a station and evaluate the triggers of every farm linked to it
+// ============================================================================================================================
+func (t *SimpleChaincode) update_weather_station(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0          1
+	//  'report'   'signature'     a station's signed Report JSON with no farm and its base64 signature, only the
+	//                             station's signature can put its name on a reading
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	fmt.Println("- start update weather station")
+	report, station, err := signedReport(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if report.Farm != "" {
+		return nil, errors.New("A report for one farm goes to update_weather")
+	}
+
+	reading := Weather{Name: report.Weather, Temperature: report.Temperature, Date: report.Date, Source: station.ID}
+	reading.Observed, err = parseDate(reading.Date)
+	if err != nil {
+		return nil, err
+	}
+	reading.Recorded, err = txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	vocabulary, err := getVocabulary(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = normalizeWeather(vocabulary, &reading)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := storeReading(stub, StationWeatherPrefix, station.ID, reading)
+	if err != nil || !stored {
+		return nil, err
+	}
+
+	//fan out to every linked farm, the station is the source so a signed report sent straight to a farm merges with it
+	for _, name := range station.Farms {
+		farm, err := getFarm(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := putWeather(stub, &farm, reading)
+		if err != nil {
+			return nil, err
+		}
+		if !stored {
+			continue
+		}
+		err = putFarm(stub, farm)
+		if err != nil {
+			return nil, err
+		}
+		err = check_triggers(stub, farm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("- end update weather station")
+	return nil, nil
+}
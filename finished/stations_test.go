@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// fakeStub keeps the world state in a map. Methods the chaincode does not call are left to the embedded nil interface.
+type fakeStub struct {
+	shim.ChaincodeStubInterface
+	state  map[string][]byte
+	caller string // username certificate attribute
+	now    int64  // transaction time, ms since epoch
+}
+
+func newFakeStub(now int64) *fakeStub {
+	stub := &fakeStub{state: map[string][]byte{}, now: now}
+	vocabularyAsBytes, _ := json.Marshal(defaultVocabulary())
+	stub.state[ConditionsStr] = vocabularyAsBytes
+	return stub
+}
+
+func (s *fakeStub) GetState(key string) ([]byte, error) { return s.state[key], nil }
+
+func (s *fakeStub) PutState(key string, value []byte) error {
+	s.state[key] = value
+	return nil
+}
+
+func (s *fakeStub) DelState(key string) error {
+	delete(s.state, key)
+	return nil
+}
+
+func (s *fakeStub) GetTxID() string { return "tx1" }
+
+func (s *fakeStub) ReadCertAttribute(name string) ([]byte, error) { return []byte(s.caller), nil }
+
+func (s *fakeStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.now / 1000, Nanos: int32(s.now%1000) * 1000000}, nil
+}
+
+// RangeQueryState includes the end key, as the v0.6 ledger does
+func (s *fakeStub) RangeQueryState(start string, end string) (shim.StateRangeQueryIteratorInterface, error) {
+	var keys []string
+	for key := range s.state {
+		if key >= start && key <= end {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &fakeIterator{stub: s, keys: keys}, nil
+}
+
+type fakeIterator struct {
+	stub *fakeStub
+	keys []string
+}
+
+func (it *fakeIterator) HasNext() bool { return len(it.keys) > 0 }
+
+func (it *fakeIterator) Next() (string, []byte, error) {
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	return key, it.stub.state[key], nil
+}
+
+func (it *fakeIterator) Close() error { return nil }
+
+var testNow = int64(1700000000000)
+
+type testSigner struct {
+	algorithm string
+	publicKey string
+	sign      func(payload []byte) string
+}
+
+func newP256Signer(t *testing.T) testSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{AlgECDSA, base64.StdEncoding.EncodeToString(der), func(payload []byte) string {
+		digest := sha256.Sum256(payload)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, _ := asn1.Marshal(ecdsaSignature{r, s})
+		return base64.StdEncoding.EncodeToString(sig)
+	}}
+}
+
+func newEd25519Signer(t *testing.T) testSigner {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{AlgEd25519, base64.StdEncoding.EncodeToString(der), func(payload []byte) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, payload))
+	}}
+}
+
+// addStation stores a station with signer's key and links it to a farm called farm1
+func addStation(t *testing.T, stub *fakeStub, id string, signer testSigner, status string) {
+	err := putStation(stub, Station{ID: id, Owner: "owner1", Algorithm: signer.algorithm, PublicKey: signer.publicKey, Status: status, Farms: []string{"farm1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	farm, err := getFarm(stub, "farm1")
+	if err != nil {
+		farm = Farm{Name: "farm1", Owner: "owner1"}
+	}
+	farm.Stations = append(farm.Stations, StationLink{Station: id, MaxKm: StationMaxKm})
+	err = putFarm(stub, farm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testReport(station string, issued int64) string {
+	reportAsBytes, _ := json.Marshal(Report{Station: station, Farm: "farm1", Weather: "rainy", Temperature: 12, Date: "2023-11-14", Issued: issued})
+	return string(reportAsBytes)
+}
+
+func TestSignedReport(t *testing.T) {
+	p256 := newP256Signer(t)
+	ed := newEd25519Signer(t)
+	other := newP256Signer(t)
+
+	cases := []struct {
+		name    string
+		signer  testSigner // key the station is registered with
+		signBy  testSigner // key the report is signed with
+		status  string
+		issued  int64
+		tamper  bool
+		wantErr string
+	}{
+		{name: "p256", signer: p256, signBy: p256, issued: testNow},
+		{name: "ed25519", signer: ed, signBy: ed, issued: testNow},
+		{name: "active status", signer: ed, signBy: ed, status: "active", issued: testNow - ReportMaxAge},
+		{name: "p256 tampered", signer: p256, signBy: p256, issued: testNow, tamper: true, wantErr: "does not match"},
+		{name: "ed25519 tampered", signer: ed, signBy: ed, issued: testNow, tamper: true, wantErr: "does not match"},
+		{name: "other key", signer: p256, signBy: other, issued: testNow, wantErr: "does not match"},
+		{name: "ed25519 signature on p256 station", signer: p256, signBy: ed, issued: testNow, wantErr: "ASN.1"},
+		{name: "p256 signature on ed25519 station", signer: ed, signBy: p256, issued: testNow, wantErr: "does not match"},
+		{name: "wrong algorithm", signer: testSigner{AlgEd25519, p256.publicKey, nil}, signBy: p256, issued: testNow, wantErr: "not an ed25519 key"},
+		{name: "stale", signer: p256, signBy: p256, issued: testNow - ReportMaxAge - 1, wantErr: "not fresh"},
+		{name: "future", signer: ed, signBy: ed, issued: testNow + ReportMaxSkew + 1, wantErr: "not fresh"},
+		{name: "skew allowed", signer: ed, signBy: ed, issued: testNow + ReportMaxSkew},
+		{name: "decommissioned", signer: p256, signBy: p256, status: "decommissioned", issued: testNow, wantErr: "decommissioned"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := newFakeStub(testNow)
+			addStation(t, stub, "station1", c.signer, c.status)
+			payload := testReport("station1", c.issued)
+			signature := c.signBy.sign([]byte(payload))
+			if c.tamper {
+				payload = strings.Replace(payload, `"temperature":12`, `"temperature":13`, 1)
+			}
+
+			report, station, err := signedReport(stub, payload, signature)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if station.ID != "station1" || report.Temperature != 12 || report.Farm != "farm1" {
+				t.Fatalf("got report %+v from station %s", report, station.ID)
+			}
+		})
+	}
+}
+
+func TestSignedReportUnknownStation(t *testing.T) {
+	stub := newFakeStub(testNow)
+	signer := newEd25519Signer(t)
+	payload := testReport("nobody", testNow)
+	if _, _, err := signedReport(stub, payload, signer.sign([]byte(payload))); err == nil {
+		t.Fatal("report from an unregistered station was accepted")
+	}
+}
+
+func TestUpdateWeatherSigned(t *testing.T) {
+	stub := newFakeStub(testNow)
+	signer := newP256Signer(t)
+	addStation(t, stub, "station1", signer, "active")
+	payload := testReport("station1", testNow)
+
+	t.Run("unsigned reading posing as the station", func(t *testing.T) {
+		stub.caller = "oracle1"
+		rolesAsBytes, _ := json.Marshal(Roles{Members: map[string][]string{OracleRole: {"oracle1"}}})
+		stub.state[RolesStr] = rolesAsBytes
+		_, err := new(SimpleChaincode).Invoke(stub, "update_weather", []string{"farm1", "sunny", "30", "2023-11-14", "station1"})
+		if err == nil || !strings.Contains(err.Error(), "must be signed") {
+			t.Fatalf("got error %v, want the unsigned reading refused", err)
+		}
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		_, err := new(SimpleChaincode).Invoke(stub, "update_weather", []string{payload, signer.sign([]byte(payload))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reading Weather
+		json.Unmarshal(stub.state[weatherKey("farm1", "2023-11-14", "station1")], &reading)
+		if reading.Name != "rainy" || reading.Temperature != 12 {
+			t.Fatalf("stored %+v", reading)
+		}
+	})
+
+	t.Run("farm not linked to the station", func(t *testing.T) {
+		err := putFarm(stub, Farm{Name: "farm2", Owner: "owner1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlinked := strings.Replace(payload, `"farm1"`, `"farm2"`, 1)
+		_, err = new(SimpleChaincode).Invoke(stub, "update_weather", []string{unlinked, signer.sign([]byte(unlinked))})
+		if err == nil || !strings.Contains(err.Error(), "not linked") {
+			t.Fatalf("got error %v, want the report for an unlinked farm refused", err)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := strings.Replace(payload, `"2023-11-14"`, `"2023-11-15"`, 1)
+		_, err := new(SimpleChaincode).Invoke(stub, "update_weather", []string{tampered, signer.sign([]byte(payload))})
+		if err == nil {
+			t.Fatal("tampered report was stored")
+		}
+		if stub.state[weatherKey("farm1", "2023-11-15", "station1")] != nil {
+			t.Fatal("tampered reading reached the ledger")
+		}
+	})
+}
+
+func TestUpdateWeatherStation(t *testing.T) {
+	stub := newFakeStub(testNow)
+	signer := newEd25519Signer(t)
+	addStation(t, stub, "station1", signer, "active")
+	stub.caller = "owner1"
+
+	if _, err := new(SimpleChaincode).Invoke(stub, "update_weather_station", []string{"station1", "rainy", "12", "2023-11-14"}); err == nil {
+		t.Fatal("the station's owner posted an unsigned reading under its name")
+	}
+
+	reportAsBytes, _ := json.Marshal(Report{Station: "station1", Weather: "rainy", Temperature: 12, Date: "2023-11-14", Issued: testNow})
+	payload := string(reportAsBytes)
+	for i := 0; i < 2; i++ { //the replay is merged away
+		if _, err := new(SimpleChaincode).Invoke(stub, "update_weather_station", []string{payload, signer.sign([]byte(payload))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	farm, _ := getFarm(stub, "farm1")
+	if stub.state[historyKey(StationWeatherPrefix, "station1", "2023-11-14", "station1")] == nil || farm.Summary.Count != 1 {
+		t.Fatalf("got a farm summary of %d readings, want the station's one reading stored once", farm.Summary.Count)
+	}
+
+	different := strings.Replace(payload, `"temperature":12`, `"temperature":14`, 1)
+	if _, err := new(SimpleChaincode).Invoke(stub, "update_weather_station", []string{different, signer.sign([]byte(different))}); err == nil || !strings.Contains(err.Error(), "different reading") {
+		t.Fatalf("got error %v, want the conflicting reading refused", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var SupplyStr = "_supply"       //name for the key/value that will store the coin supply
+var AccountPrefix = "_account/" //every system account's balance lives at _account/<name>
+var FaucetAccount = "@faucet"   //minted coin new users are funded from
+
+var ReasonMint = "mint" //coin created by an admin
+var ReasonBurn = "burn" //coin destroyed
+
+type Supply struct {
+	Total  int `json:"total"`  // coin in existence, Minted - Burned
+	Minted int `json:"minted"` // coin ever minted
+	Burned int `json:"burned"` // coin ever burned
+}
+
+type Account struct { //a balance held by the chaincode itself rather than a user
+	Name    string `json:"name"`    // starts with @
+	Balance int    `json:"balance"` // only IssuanceAccount may go below zero, it mirrors the supply
+}
+
+type SupplyCheck struct {
+	Total      int            `json:"total"`      // supply on the ledger
+	UserCoin   int            `json:"user_coin"`  // sum of every User.Coin
+	Accounts   map[string]int `json:"accounts"`   // system account balances, issuance left out
+	Issuance   int            `json:"issuance"`   // IssuanceAccount balance, -Total when consistent
+	Consistent bool           `json:"consistent"` // UserCoin plus Accounts equals Total
+}
+
+func getSupply(stub shim.ChaincodeStubInterface) (Supply, error) {
+	var supply Supply
+	supplyAsBytes, err := stub.GetState(SupplyStr)
+	if err != nil {
+		return supply, errors.New("Failed to get supply")
+	}
+	json.Unmarshal(supplyAsBytes, &supply)
+	return supply, nil
+}
+
+func putSupply(stub shim.ChaincodeStubInterface, supply Supply) error {
+	supplyAsBytes, _ := json.Marshal(supply)
+	return stub.PutState(SupplyStr, supplyAsBytes)
+}
+
+func getAccount(stub shim.ChaincodeStubInterface, name string) (Account, error) {
+	account := Account{Name: name}
+	accountAsBytes, err := stub.GetState(AccountPrefix + name)
+	if err != nil {
+		return account, errors.New("Failed to get account " + name)
+	}
+	json.Unmarshal(accountAsBytes, &account)
+	return account, nil
+}
+
+func putAccount(stub shim.ChaincodeStubInterface, account Account) error {
+	accountAsBytes, _ := json.Marshal(account)
+	return stub.PutState(AccountPrefix+account.Name, accountAsBytes)
+}
+
+// ============================================================================================================================
+// Mint - create coin into a user or system account, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) mint(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0          1         2
+	//  'account'  'amount'  'reason'     account is a user name or a system account such as @faucet
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start mint")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	account := strings.ToLower(args[0])
+	if len(account) <= 0 || account == IssuanceAccount {
+		return nil, errors.New("1st argument must name the account to mint into")
+	}
+	amount, err := strconv.Atoi(args[1])
+	if err != nil || amount <= 0 {
+		return nil, errors.New("2nd argument must be a positive numeric string")
+	}
+	if len(args[2]) <= 0 {
+		return nil, errors.New("3rd argument must give a reason")
+	}
+
+	err = move(stub, IssuanceAccount, account, amount, ReasonMint+": "+args[2], "")
+	if err != nil {
+		return nil, err
+	}
+	supply, err := getSupply(stub)
+	if err != nil {
+		return nil, err
+	}
+	supply.Minted += amount
+	supply.Total += amount
+	err = putSupply(stub, supply)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end mint")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Burn - destroy coin, users burn their own and admins may burn from system accounts
+// ============================================================================================================================
+func (t *SimpleChaincode) burn(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0          1         2
+	//  'account'  'amount'  'reason'
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	fmt.Println("- start burn")
+	account := strings.ToLower(args[0])
+	if len(account) <= 0 || account == IssuanceAccount {
+		return nil, errors.New("1st argument must name the account to burn from")
+	}
+	amount, err := strconv.Atoi(args[1])
+	if err != nil || amount <= 0 {
+		return nil, errors.New("2nd argument must be a positive numeric string")
+	}
+	if len(args[2]) <= 0 {
+		return nil, errors.New("3rd argument must give a reason")
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	if isSystemAccount(account) {
+		if _, err = requireRole(stub, AdminRole); err != nil {
+			return nil, err
+		}
+	} else if account != caller {
+		return nil, errors.New("Users can only burn their own coin")
+	}
+
+	err = move(stub, account, IssuanceAccount, amount, ReasonBurn+": "+args[2], "")
+	if err != nil {
+		return nil, err
+	}
+	supply, err := getSupply(stub)
+	if err != nil {
+		return nil, err
+	}
+	supply.Burned += amount
+	supply.Total -= amount
+	err = putSupply(stub, supply)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end burn")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Verify Supply - check that users' coin plus system account balances adds up to the supply
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_supply(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+	supply, err := getSupply(stub)
+	if err != nil {
+		return nil, err
+	}
+	check := SupplyCheck{Total: supply.Total, Accounts: map[string]int{}}
+
+	iter, err := stub.RangeQueryState(AccountPrefix, AccountPrefix+KeyMax)
+	if err != nil {
+		return nil, errors.New("Failed to range over accounts")
+	}
+	held := 0
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		var account Account
+		json.Unmarshal(valAsbytes, &account)
+		if account.Name == IssuanceAccount {
+			check.Issuance = account.Balance
+			continue
+		}
+		check.Accounts[account.Name] = account.Balance
+		held += account.Balance
+	}
+	iter.Close()
+
+	names, err := allIndexed(stub, UserIndexPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		user, err := getUser(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		check.UserCoin += user.Coin
+	}
+
+	check.Consistent = check.UserCoin+held == supply.Total && check.Issuance == -supply.Total
+	return json.Marshal(check)
+}
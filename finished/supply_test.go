@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVerifySupply(t *testing.T) {
+	cases := []struct {
+		name       string
+		change     func(stub *fakeStub) error
+		total      int
+		consistent bool
+	}{
+		{"untouched", func(stub *fakeStub) error { return nil }, 100, true},
+		{"mint into a user", func(stub *fakeStub) error {
+			_, err := new(SimpleChaincode).Invoke(stub, "mint", []string{"ben", "25", "grant"})
+			return err
+		}, 125, true},
+		{"mint into an account", func(stub *fakeStub) error {
+			_, err := new(SimpleChaincode).Invoke(stub, "mint", []string{FaucetAccount, "40", "top up"})
+			return err
+		}, 140, true},
+		{"burn from a user", func(stub *fakeStub) error {
+			stub.caller = "ben"
+			_, err := new(SimpleChaincode).Invoke(stub, "burn", []string{"ben", "10", "spent"})
+			return err
+		}, 90, true},
+		{"user edited", func(stub *fakeStub) error {
+			return putUser(stub, User{Name: "ben", Coin: 31})
+		}, 100, false},
+		{"account edited", func(stub *fakeStub) error {
+			return putAccount(stub, Account{Name: InsurerAccount, Balance: 0})
+		}, 100, false},
+		{"supply edited", func(stub *fakeStub) error {
+			return putSupply(stub, Supply{Total: 101, Minted: 101})
+		}, 101, false},
+		{"issuance edited", func(stub *fakeStub) error {
+			return putAccount(stub, Account{Name: IssuanceAccount, Balance: -99})
+		}, 100, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := newFakeStub(testNow)
+			stub.caller = "alice"
+			if _, err := new(SimpleChaincode).Init(stub, "init", []string{"1", "alice", "100"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := putUser(stub, User{Name: "ben"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := putIndex(stub, UserIndexPrefix, "ben"); err != nil {
+				t.Fatal(err)
+			}
+			if err := move(stub, InsurerAccount, "ben", 30, ReasonPayout, ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.change(stub); err != nil {
+				t.Fatal(err)
+			}
+
+			checkAsBytes, err := new(SimpleChaincode).verify_supply(stub, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var check SupplyCheck
+			json.Unmarshal(checkAsBytes, &check)
+			if check.Total != c.total || check.Consistent != c.consistent {
+				t.Fatalf("got total %d consistent %v, want %d %v: %+v", check.Total, check.Consistent, c.total, c.consistent, check)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+// Package trigger evaluates parametric trigger rules. It works on plain series of samples and never touches the
+// ledger, so rules can be checked and run the same way wherever the samples came from. Rules are trees of Expr:
+// literals, fields of one sample, comparisons, && || and !, and aggregates that fold a field or a condition over a
+// sliding window. Compile builds them from rule text.
+package trigger
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+type Kind int
+
+const (
+	KindNumber Kind = iota
+	KindBool
+	KindString
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNumber:
+		return "number"
+	case KindBool:
+		return "bool"
+	}
+	return "string"
+}
+
+type Value struct {
+	Kind   Kind
+	Number float64
+	Bool   bool
+	String string
+}
+
+type Sample struct {
+	At      int64              // ms since epoch
+	Numbers map[string]float64 // numeric fields by name
+	Strings map[string]string  // string fields by name
+}
+
+type Window struct { //the samples an aggregate folds over, ending at the evaluation time
+	Duration int64 // ms, the samples with At in (Now-Duration, Now]
+	Count    int   // the latest Count samples, read when Duration is 0. Both 0 takes the whole series.
+}
+
+type Env struct {
+	Series []Sample // oldest first
+	Now    int64    // evaluation time, windows end here and samples after it are ignored
+	row    *Sample  // sample a Field reads, set while an aggregate walks its window
+}
+
+type Expr interface {
+	Check(row bool) (Kind, error) // kind of the result, row is true inside an aggregate where fields can be read
+	Eval(env *Env) (Value, error)
+	Position() int
+}
+
+// Pos is the 1-based column a node starts at in its rule text, 0 for nodes built in code. Errors about a node
+// report it.
+type Pos int
+
+func (p Pos) Position() int {
+	return int(p)
+}
+
+type Error struct {
+	Position int    // 1-based column the error was found at, 0 when not known
+	Message  string // what is wrong
+}
+
+func (e Error) Error() string {
+	if e.Position == 0 {
+		return e.Message
+	}
+	return "col " + strconv.Itoa(e.Position) + ": " + e.Message
+}
+
+type Literal struct {
+	Value Value
+	Pos
+}
+
+type Field struct {
+	Name string
+	Kind Kind
+	Pos
+}
+
+type Compare struct {
+	Op          string // == != < <= > >=
+	Left, Right Expr
+	Pos         // of the operator
+}
+
+type Logic struct {
+	Op          string // && ||
+	Left, Right Expr
+	Pos         // of the operator
+}
+
+type Not struct {
+	X Expr
+	Pos
+}
+
+type Aggregate struct {
+	Func   string // sum mean min max take a number, count and consecutive take a bool
+	Arg    Expr   // evaluated on every sample in the window
+	Window Window
+	Step   int64 // consecutive only, ms two samples may be apart and still be in a run, 0 ignores gaps
+	Pos
+}
+
+// slice returns the samples of series the window covers at now
+func (w Window) slice(series []Sample, now int64) []Sample {
+	end := len(series)
+	for end > 0 && series[end-1].At > now {
+		end--
+	}
+	start := 0
+	if w.Duration > 0 {
+		for start < end && series[start].At <= now-w.Duration {
+			start++
+		}
+	} else if w.Count > 0 && end > w.Count {
+		start = end - w.Count
+	}
+	return series[start:end]
+}
+
+func (e Literal) Check(row bool) (Kind, error) {
+	return e.Value.Kind, nil
+}
+
+func (e Literal) Eval(env *Env) (Value, error) {
+	return e.Value, nil
+}
+
+func (e Field) Check(row bool) (Kind, error) {
+	if !row {
+		return e.Kind, Error{e.Position(), "Field " + e.Name + " can only be read inside an aggregate"}
+	}
+	if e.Kind == KindBool {
+		return e.Kind, Error{e.Position(), "Field " + e.Name + " must be a number or a string"}
+	}
+	return e.Kind, nil
+}
+
+func (e Field) Eval(env *Env) (Value, error) {
+	if env.row == nil {
+		return Value{}, errors.New("Field " + e.Name + " read outside an aggregate")
+	}
+	if e.Kind == KindNumber {
+		number, ok := env.row.Numbers[e.Name]
+		if !ok {
+			return Value{}, errors.New("Sample has no number " + e.Name)
+		}
+		return Value{Kind: KindNumber, Number: number}, nil
+	}
+	str, ok := env.row.Strings[e.Name]
+	if !ok {
+		return Value{}, errors.New("Sample has no string " + e.Name)
+	}
+	return Value{Kind: KindString, String: str}, nil
+}
+
+func (e Compare) Check(row bool) (Kind, error) {
+	left, err := e.Left.Check(row)
+	if err != nil {
+		return KindBool, err
+	}
+	right, err := e.Right.Check(row)
+	if err != nil {
+		return KindBool, err
+	}
+	if left != right {
+		return KindBool, Error{e.Position(), "Cannot compare a " + left.String() + " with a " + right.String()}
+	}
+	switch e.Op {
+	case "==", "!=":
+	case "<", "<=", ">", ">=":
+		if left != KindNumber {
+			return KindBool, Error{e.Position(), "Only numbers can be ordered with " + e.Op}
+		}
+	default:
+		return KindBool, Error{e.Position(), "Unknown comparison " + e.Op}
+	}
+	return KindBool, nil
+}
+
+// Eval compares two values, NaN from an empty window's mean, min or max compares false with anything
+func (e Compare) Eval(env *Env) (Value, error) {
+	left, err := e.Left.Eval(env)
+	if err != nil {
+		return Value{}, err
+	}
+	right, err := e.Right.Eval(env)
+	if err != nil {
+		return Value{}, err
+	}
+	if left.Kind != right.Kind {
+		return Value{}, errors.New("Cannot compare a " + left.Kind.String() + " with a " + right.Kind.String())
+	}
+	result := false
+	switch left.Kind {
+	case KindNumber:
+		a, b := left.Number, right.Number
+		switch e.Op {
+		case "==":
+			result = a == b
+		case "!=":
+			result = a != b && !math.IsNaN(a) && !math.IsNaN(b)
+		case "<":
+			result = a < b
+		case "<=":
+			result = a <= b
+		case ">":
+			result = a > b
+		case ">=":
+			result = a >= b
+		}
+	case KindString:
+		result = (left.String == right.String) == (e.Op == "==")
+	case KindBool:
+		result = (left.Bool == right.Bool) == (e.Op == "==")
+	}
+	return Value{Kind: KindBool, Bool: result}, nil
+}
+
+func (e Logic) Check(row bool) (Kind, error) {
+	if e.Op != "&&" && e.Op != "||" {
+		return KindBool, Error{e.Position(), "Unknown operator " + e.Op}
+	}
+	for _, x := range []Expr{e.Left, e.Right} {
+		kind, err := x.Check(row)
+		if err != nil {
+			return KindBool, err
+		}
+		if kind != KindBool {
+			return KindBool, Error{x.Position(), e.Op + " needs bools, not a " + kind.String()}
+		}
+	}
+	return KindBool, nil
+}
+
+// Eval short-circuits like Go, the right side is only evaluated when it decides the result
+func (e Logic) Eval(env *Env) (Value, error) {
+	left, err := e.Left.Eval(env)
+	if err != nil {
+		return Value{}, err
+	}
+	if left.Bool == (e.Op == "||") {
+		return left, nil
+	}
+	return e.Right.Eval(env)
+}
+
+func (e Not) Check(row bool) (Kind, error) {
+	kind, err := e.X.Check(row)
+	if err != nil {
+		return KindBool, err
+	}
+	if kind != KindBool {
+		return KindBool, Error{e.X.Position(), "! needs a bool, not a " + kind.String()}
+	}
+	return KindBool, nil
+}
+
+func (e Not) Eval(env *Env) (Value, error) {
+	x, err := e.X.Eval(env)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{Kind: KindBool, Bool: !x.Bool}, nil
+}
+
+func (e Aggregate) Check(row bool) (Kind, error) {
+	if row {
+		return KindNumber, Error{e.Position(), "Aggregates cannot be nested, " + e.Func + " is inside another"}
+	}
+	if e.Window.Duration < 0 || e.Window.Count < 0 || e.Step < 0 {
+		return KindNumber, Error{e.Position(), "Window of " + e.Func + " cannot be negative"}
+	}
+	kind, err := e.Arg.Check(true)
+	if err != nil {
+		return KindNumber, err
+	}
+	want := KindNumber
+	switch e.Func {
+	case "sum", "mean", "min", "max":
+	case "count", "consecutive":
+		want = KindBool
+	default:
+		return KindNumber, Error{e.Position(), "Unknown aggregate " + e.Func}
+	}
+	if kind != want {
+		return KindNumber, Error{e.Arg.Position(), e.Func + " needs a " + want.String() + ", not a " + kind.String()}
+	}
+	return KindNumber, nil
+}
+
+// Eval folds Arg over the window. The sum and count of an empty window are 0, its mean, min and max are NaN.
+// consecutive counts the samples in a row at the end of the window for which Arg holds.
+func (e Aggregate) Eval(env *Env) (Value, error) {
+	samples := e.Window.slice(env.Series, env.Now)
+	values := make([]Value, len(samples))
+	for i := range samples {
+		inner := Env{Series: env.Series, Now: env.Now, row: &samples[i]}
+		value, err := e.Arg.Eval(&inner)
+		if err != nil {
+			return Value{}, err
+		}
+		values[i] = value
+	}
+
+	result := 0.0
+	switch e.Func {
+	case "sum", "mean":
+		for _, value := range values {
+			result += value.Number
+		}
+		if e.Func == "mean" {
+			result /= float64(len(values))
+		}
+	case "min", "max":
+		result = math.NaN()
+		for i, value := range values {
+			if i == 0 || (e.Func == "min" && value.Number < result) || (e.Func == "max" && value.Number > result) {
+				result = value.Number
+			}
+		}
+	case "count":
+		for _, value := range values {
+			if value.Bool {
+				result++
+			}
+		}
+	case "consecutive":
+		for i := len(values) - 1; i >= 0 && values[i].Bool; i-- {
+			if i < len(values)-1 && e.Step > 0 && samples[i+1].At-samples[i].At > e.Step {
+				break
+			}
+			result++
+		}
+	default:
+		return Value{}, errors.New("Unknown aggregate " + e.Func)
+	}
+	return Value{Kind: KindNumber, Number: result}, nil
+}
+
+// Evaluate checks that rule is a well-typed condition and evaluates it over series at now
+func Evaluate(rule Expr, series []Sample, now int64) (bool, error) {
+	kind, err := rule.Check(false)
+	if err != nil {
+		return false, err
+	}
+	if kind != KindBool {
+		return false, Error{rule.Position(), "A rule must be a condition, not a " + kind.String()}
+	}
+	value, err := rule.Eval(&Env{Series: series, Now: now})
+	if err != nil {
+		return false, err
+	}
+	return value.Bool, nil
+}
+
+// NumberLiteral is a number constant
+func NumberLiteral(n float64) Expr {
+	return Literal{Value: Value{Kind: KindNumber, Number: n}}
+}
+
+// StringLiteral is a string constant
+func StringLiteral(s string) Expr {
+	return Literal{Value: Value{Kind: KindString, String: s}}
+}
@@ -0,0 +1,230 @@
+package trigger
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+const day = int64(24 * 60 * 60 * 1000)
+
+// series has one sample a day from day 1, rain is the number of each day and weather "rainy" when it is above 5
+func series(rain ...float64) []Sample {
+	samples := make([]Sample, len(rain))
+	for i, r := range rain {
+		weather := "dry"
+		if r > 5 {
+			weather = "rainy"
+		}
+		samples[i] = Sample{At: int64(i+1) * day, Numbers: map[string]float64{"rain": r}, Strings: map[string]string{"weather": weather}}
+	}
+	return samples
+}
+
+var rain = Field{Name: "rain", Kind: KindNumber}
+var weather = Field{Name: "weather", Kind: KindString}
+var rainy = Compare{Op: "==", Left: weather, Right: StringLiteral("rainy")}
+
+func aggregate(fn string, arg Expr, window Window) Aggregate {
+	return Aggregate{Func: fn, Arg: arg, Window: window}
+}
+
+func TestAggregate(t *testing.T) {
+	days := series(1, 8, 3, 9, 7)
+	nan := math.NaN()
+	cases := []struct {
+		name string
+		expr Aggregate
+		now  int64
+		want float64
+	}{
+		{"sum all", aggregate("sum", rain, Window{}), 5 * day, 28},
+		{"sum count", aggregate("sum", rain, Window{Count: 2}), 5 * day, 16},
+		{"sum duration", aggregate("sum", rain, Window{Duration: 3 * day}), 5 * day, 19},
+		{"sum ignores the future", aggregate("sum", rain, Window{}), 3 * day, 12},
+		{"sum count past now", aggregate("sum", rain, Window{Count: 2}), 3 * day, 11},
+		{"sum count larger than series", aggregate("sum", rain, Window{Count: 10}), 5 * day, 28},
+		{"sum empty", aggregate("sum", rain, Window{}), 0, 0},
+		{"mean count", aggregate("mean", rain, Window{Count: 4}), 5 * day, 27.0 / 4},
+		{"mean duration", aggregate("mean", rain, Window{Duration: 2 * day}), 5 * day, 8},
+		{"mean empty", aggregate("mean", rain, Window{Duration: day}), 10 * day, nan},
+		{"min count", aggregate("min", rain, Window{Count: 3}), 5 * day, 3},
+		{"min duration", aggregate("min", rain, Window{Duration: 2 * day}), 5 * day, 7},
+		{"min empty", aggregate("min", rain, Window{Count: 3}), 0, nan},
+		{"max count", aggregate("max", rain, Window{Count: 2}), 3 * day, 8},
+		{"max duration", aggregate("max", rain, Window{Duration: 5 * day}), 5 * day, 9},
+		{"max empty", aggregate("max", rain, Window{Duration: day}), 10 * day, nan},
+		{"count all", aggregate("count", rainy, Window{}), 5 * day, 3},
+		{"count count", aggregate("count", rainy, Window{Count: 2}), 5 * day, 2},
+		{"count duration", aggregate("count", rainy, Window{Duration: 3 * day}), 3 * day, 1},
+		{"count empty", aggregate("count", rainy, Window{}), 0, 0},
+		{"consecutive", aggregate("consecutive", rainy, Window{}), 5 * day, 2},
+		{"consecutive count", aggregate("consecutive", rainy, Window{Count: 1}), 5 * day, 1},
+		{"consecutive duration", aggregate("consecutive", rainy, Window{Duration: 4 * day}), 5 * day, 2},
+		{"consecutive broken", aggregate("consecutive", rainy, Window{}), 3 * day, 0},
+		{"consecutive empty", aggregate("consecutive", rainy, Window{}), 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := c.expr.Check(false); err != nil {
+				t.Fatal(err)
+			}
+			value, err := c.expr.Eval(&Env{Series: days, Now: c.now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value.Kind != KindNumber {
+				t.Fatalf("got a %s", value.Kind)
+			}
+			if math.IsNaN(c.want) != math.IsNaN(value.Number) || (!math.IsNaN(c.want) && value.Number != c.want) {
+				t.Fatalf("got %v, want %v", value.Number, c.want)
+			}
+		})
+	}
+}
+
+func TestConsecutiveStep(t *testing.T) {
+	// rainy on days 1, 2, 4 and 5, day 3 has no reading
+	days := series(8, 9, 7, 6)
+	days[2].At, days[3].At = 4*day, 5*day
+	cases := []struct {
+		name string
+		step int64
+		want float64
+	}{
+		{"gaps ignored", 0, 4},
+		{"daily", day, 2},
+		{"two days", 2 * day, 4},
+		{"just under a day", day - 1, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expr := Aggregate{Func: "consecutive", Arg: rainy, Step: c.step}
+			value, err := expr.Eval(&Env{Series: days, Now: 5 * day})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value.Number != c.want {
+				t.Fatalf("got %v, want %v", value.Number, c.want)
+			}
+		})
+	}
+}
+
+func TestCompareNaN(t *testing.T) {
+	empty := aggregate("mean", rain, Window{Duration: day})
+	for _, op := range []string{"==", "!=", "<", "<=", ">", ">="} {
+		t.Run(op, func(t *testing.T) {
+			held, err := Evaluate(Compare{Op: op, Left: empty, Right: NumberLiteral(0)}, series(1, 2), 10*day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if held {
+				t.Fatalf("NaN %s 0 held", op)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	days := series(1, 8, 3, 9, 7)
+	wet := Compare{Op: ">=", Left: aggregate("count", rainy, Window{Count: 3}), Right: NumberLiteral(2)}
+	dry := Compare{Op: "<", Left: aggregate("sum", rain, Window{Count: 2}), Right: NumberLiteral(10)}
+	cases := []struct {
+		name string
+		rule Expr
+		want bool
+	}{
+		{"compare", wet, true},
+		{"and", Logic{Op: "&&", Left: wet, Right: dry}, false},
+		{"or", Logic{Op: "||", Left: dry, Right: wet}, true},
+		{"not", Not{X: dry}, true},
+		{"string literals", Compare{Op: "!=", Left: StringLiteral("a"), Right: StringLiteral("b")}, true},
+		{"bool literals", Compare{Op: "==", Left: Not{X: wet}, Right: dry}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			held, err := Evaluate(c.rule, days, 5*day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if held != c.want {
+				t.Fatalf("got %v, want %v", held, c.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name    string
+		rule    Expr
+		wantErr string
+	}{
+		{"number rule", aggregate("sum", rain, Window{}), "must be a condition"},
+		{"field outside aggregate", Compare{Op: ">", Left: rain, Right: NumberLiteral(1)}, "inside an aggregate"},
+		{"bool field", Compare{Op: ">", Left: aggregate("count", Field{Name: "flag", Kind: KindBool}, Window{}), Right: NumberLiteral(1)}, "number or a string"},
+		{"mixed kinds", Compare{Op: "==", Left: NumberLiteral(1), Right: StringLiteral("1")}, "Cannot compare"},
+		{"ordered strings", Compare{Op: "<", Left: StringLiteral("a"), Right: StringLiteral("b")}, "Only numbers"},
+		{"unknown comparison", Compare{Op: "=<", Left: NumberLiteral(1), Right: NumberLiteral(2)}, "Unknown comparison"},
+		{"logic on numbers", Logic{Op: "&&", Left: NumberLiteral(1), Right: rainy}, "needs bools"},
+		{"unknown logic", Logic{Op: "^", Left: rainy, Right: rainy}, "Unknown operator"},
+		{"not a number", Not{X: NumberLiteral(1)}, "needs a bool"},
+		{"nested aggregate", Compare{Op: ">", Left: aggregate("sum", aggregate("sum", rain, Window{}), Window{}), Right: NumberLiteral(1)}, "cannot be nested"},
+		{"negative window", Compare{Op: ">", Left: aggregate("sum", rain, Window{Count: -1}), Right: NumberLiteral(1)}, "cannot be negative"},
+		{"negative step", Compare{Op: ">", Left: Aggregate{Func: "consecutive", Arg: rainy, Step: -1}, Right: NumberLiteral(1)}, "cannot be negative"},
+		{"unknown aggregate", Compare{Op: ">", Left: aggregate("median", rain, Window{}), Right: NumberLiteral(1)}, "Unknown aggregate"},
+		{"sum of a bool", Compare{Op: ">", Left: aggregate("sum", rainy, Window{}), Right: NumberLiteral(1)}, "needs a number"},
+		{"count of a number", Compare{Op: ">", Left: aggregate("count", rain, Window{}), Right: NumberLiteral(1)}, "needs a bool"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Evaluate(c.rule, series(1, 8), 2*day)
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestMissingField(t *testing.T) {
+	rule := Compare{Op: ">", Left: aggregate("sum", Field{Name: "wind", Kind: KindNumber}, Window{}), Right: NumberLiteral(1)}
+	if _, err := Evaluate(rule, series(1), day); err == nil || !strings.Contains(err.Error(), "no number wind") {
+		t.Fatalf("got error %v, want the missing field reported", err)
+	}
+}
+
+// FuzzEvaluate runs a rule over every aggregate and window the inputs pick on an arbitrary series. It must never panic
+// and, with no samples in the window, mean, min and max must compare false.
+func FuzzEvaluate(f *testing.F) {
+	f.Add(uint8(0), int64(0), 0, int64(0), int64(5), 3.0, []byte{1, 8, 3, 9, 7})
+	f.Add(uint8(5), int64(2*day), 0, day, int64(5), 1.0, []byte{8, 9, 0, 7})
+	f.Add(uint8(2), int64(0), 2, int64(0), int64(0), 0.0, []byte{})
+	funcs := []string{"sum", "mean", "min", "max", "count", "consecutive"}
+	f.Fuzz(func(t *testing.T, fn uint8, duration int64, count int, step int64, now int64, threshold float64, rain []byte) {
+		days := make([]float64, len(rain))
+		for i, r := range rain {
+			days[i] = float64(r)
+		}
+		name := funcs[int(fn)%len(funcs)]
+		var arg Expr = Field{Name: "rain", Kind: KindNumber}
+		if name == "count" || name == "consecutive" {
+			arg = rainy
+		}
+		agg := Aggregate{Func: name, Arg: arg, Window: Window{Duration: duration, Count: count}, Step: step}
+		rule := Compare{Op: ">=", Left: agg, Right: NumberLiteral(threshold)}
+		held, err := Evaluate(rule, series(days...), now*day)
+		if duration < 0 || count < 0 || step < 0 {
+			if err == nil {
+				t.Fatal("negative window accepted")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if held && len(agg.Window.slice(series(days...), now*day)) == 0 && (name == "mean" || name == "min" || name == "max") {
+			t.Fatalf("%s of an empty window compared true", name)
+		}
+	})
+}
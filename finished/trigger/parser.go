@@ -0,0 +1,326 @@
+package trigger
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trigger rules are written in a small expression language and compiled to evaluator trees, for example
+//
+//	consecutive(condition == "rainy") >= 3 && min(temperature, 3d) < 5
+//
+// A rule is a condition built from comparisons, && || ! and parentheses. Aggregates read the fields of the
+// samples: sum mean min max of a number, count and consecutive of a condition. Their second argument is a
+// window, a duration such as 3d 12h 30m or a number of samples, and by default they see the whole series.
+// consecutive takes a third argument, the gap that breaks a run, a day by default. There are no loops, variables
+// or calls besides the aggregates, so every rule runs in time bounded by its length.
+
+var MaxLength = 512 //longest rule text accepted
+var MaxDepth = 32   //deepest nesting of parentheses and operators accepted
+
+var Day = int64(24 * time.Hour / time.Millisecond)
+
+type token struct {
+	kind string // number duration string ident op ( ) , end
+	text string
+	pos  int
+}
+
+// lex splits rule text into tokens
+func lex(text string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(text) {
+		c := text[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c >= '0' && c <= '9':
+			for i < len(text) && (text[i] >= '0' && text[i] <= '9' || text[i] == '.') {
+				i++
+			}
+			kind := "number"
+			if i < len(text) && strings.IndexByte("dhm", text[i]) >= 0 {
+				i++
+				kind = "duration"
+			}
+			tokens = append(tokens, token{kind, text[start:i], start + 1})
+			continue
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			for i < len(text) && (text[i] == '_' || text[i] >= 'a' && text[i] <= 'z' || text[i] >= 'A' && text[i] <= 'Z' || text[i] >= '0' && text[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{"ident", strings.ToLower(text[start:i]), start + 1})
+			continue
+		case c == '"':
+			var value []byte
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+				}
+				value = append(value, text[i])
+			}
+			if i >= len(text) {
+				return nil, Error{start + 1, "string is not closed"}
+			}
+			i++
+			tokens = append(tokens, token{"string", string(value), start + 1})
+			continue
+		case c == '(' || c == ')' || c == ',':
+			i++
+			tokens = append(tokens, token{string(c), string(c), start + 1})
+			continue
+		}
+		for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "-"} {
+			if strings.HasPrefix(text[i:], op) {
+				i += len(op)
+				tokens = append(tokens, token{"op", op, start + 1})
+				break
+			}
+		}
+		if i == start {
+			return nil, Error{start + 1, "unexpected " + strconv.Quote(string(c))}
+		}
+	}
+	return append(tokens, token{"end", "", len(text) + 1}), nil
+}
+
+type parser struct {
+	tokens    []token
+	next      int
+	depth     int
+	fields    map[string]Kind // fields a rule may read
+	maxWindow int             // most samples, or days, a window may span
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) take() token {
+	tok := p.tokens[p.next]
+	if tok.kind != "end" {
+		p.next++
+	}
+	return tok
+}
+
+func (p *parser) expect(kind string) (token, error) {
+	tok := p.take()
+	if tok.kind != kind {
+		return tok, Error{tok.pos, "expected " + kind + ", found " + describe(tok)}
+	}
+	return tok, nil
+}
+
+func describe(tok token) string {
+	if tok.kind == "end" {
+		return "end of rule"
+	}
+	return strconv.Quote(tok.text)
+}
+
+// enter guards against rules nested deeper than MaxDepth
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > MaxDepth {
+		return Error{p.peek().pos, "rule is nested too deeply"}
+	}
+	return nil
+}
+
+// or := and { "||" and }
+func (p *parser) or() (Expr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	left, err := p.and()
+	for err == nil && p.peek().text == "||" && p.peek().kind == "op" {
+		op := p.take()
+		var right Expr
+		right, err = p.and()
+		left = Logic{Op: "||", Left: left, Right: right, Pos: Pos(op.pos)}
+	}
+	return left, err
+}
+
+// and := unary { "&&" unary }
+func (p *parser) and() (Expr, error) {
+	left, err := p.unary()
+	for err == nil && p.peek().text == "&&" && p.peek().kind == "op" {
+		op := p.take()
+		var right Expr
+		right, err = p.unary()
+		left = Logic{Op: "&&", Left: left, Right: right, Pos: Pos(op.pos)}
+	}
+	return left, err
+}
+
+// unary := "!" unary | comparison
+func (p *parser) unary() (Expr, error) {
+	if p.peek().kind == "op" && p.peek().text == "!" {
+		op := p.take()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		x, err := p.unary()
+		return Not{X: x, Pos: Pos(op.pos)}, err
+	}
+	return p.comparison()
+}
+
+// comparison := primary [ op primary ], comparisons do not chain
+func (p *parser) comparison() (Expr, error) {
+	left, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.take()
+		right, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		return Compare{Op: op.text, Left: left, Right: right, Pos: Pos(op.pos)}, nil
+	}
+	return left, nil
+}
+
+// primary := number | "-" number | string | true | false | field | aggregate | "(" or ")"
+func (p *parser) primary() (Expr, error) {
+	tok := p.take()
+	switch tok.kind {
+	case "number":
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, Error{tok.pos, "bad number " + strconv.Quote(tok.text)}
+		}
+		return Literal{Value: Value{Kind: KindNumber, Number: n}, Pos: Pos(tok.pos)}, nil
+	case "string":
+		return Literal{Value: Value{Kind: KindString, String: tok.text}, Pos: Pos(tok.pos)}, nil
+	case "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(")")
+		return x, err
+	case "op":
+		if tok.text == "-" {
+			x, err := p.primary()
+			if lit, ok := x.(Literal); ok && lit.Value.Kind == KindNumber {
+				return Literal{Value: Value{Kind: KindNumber, Number: -lit.Value.Number}, Pos: Pos(tok.pos)}, err
+			}
+			if err == nil {
+				err = Error{tok.pos, "- must be followed by a number"}
+			}
+			return nil, err
+		}
+	case "ident":
+		if tok.text == "true" || tok.text == "false" {
+			return Literal{Value: Value{Kind: KindBool, Bool: tok.text == "true"}, Pos: Pos(tok.pos)}, nil
+		}
+		if p.peek().kind == "(" {
+			return p.aggregate(tok)
+		}
+		kind, ok := p.fields[tok.text]
+		if !ok {
+			return nil, Error{tok.pos, "unknown field " + strconv.Quote(tok.text)}
+		}
+		return Field{Name: tok.text, Kind: kind, Pos: Pos(tok.pos)}, nil
+	}
+	return nil, Error{tok.pos, "unexpected " + describe(tok)}
+}
+
+// aggregate := name "(" or [ "," window [ "," duration ] ] ")"
+func (p *parser) aggregate(name token) (Expr, error) {
+	switch name.text {
+	case "sum", "mean", "min", "max", "count", "consecutive":
+	default:
+		return nil, Error{name.pos, "unknown aggregate " + strconv.Quote(name.text)}
+	}
+	p.take()
+	arg, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	agg := Aggregate{Func: name.text, Arg: arg, Pos: Pos(name.pos)}
+	if name.text == "consecutive" {
+		agg.Step = Day
+	}
+	if p.peek().kind == "," {
+		p.take()
+		tok := p.take()
+		switch tok.kind {
+		case "duration":
+			agg.Window.Duration, err = p.duration(tok)
+		case "number":
+			agg.Window.Count, err = strconv.Atoi(tok.text)
+			if err != nil || agg.Window.Count <= 0 || agg.Window.Count > p.maxWindow {
+				err = Error{tok.pos, "window must be between 1 and " + strconv.Itoa(p.maxWindow) + " readings"}
+			}
+		default:
+			err = Error{tok.pos, "expected a window, found " + describe(tok)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind == "," {
+			p.take()
+			tok := p.take()
+			if name.text != "consecutive" || tok.kind != "duration" {
+				return nil, Error{tok.pos, "only consecutive takes a gap, as a duration"}
+			}
+			agg.Step, err = p.duration(tok)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	_, err = p.expect(")")
+	return agg, err
+}
+
+// duration reads 3d 12h 30m as ms, no longer than maxWindow days
+func (p *parser) duration(tok token) (int64, error) {
+	n, err := strconv.Atoi(tok.text[:len(tok.text)-1])
+	unit := map[byte]int64{'d': Day, 'h': Day / 24, 'm': Day / 24 / 60}[tok.text[len(tok.text)-1]]
+	if err != nil || n <= 0 || int64(n)*unit > int64(p.maxWindow)*Day {
+		return 0, Error{tok.pos, "duration must be a whole number of d, h or m up to " + strconv.Itoa(p.maxWindow) + "d"}
+	}
+	return int64(n) * unit, nil
+}
+
+// Compile parses and type checks rule text into a condition Evaluate can run. Rules may read fields, and a window
+// spans at most maxWindow samples or days. Errors are an Error with the column of the offending token or node.
+func Compile(text string, fields map[string]Kind, maxWindow int) (Expr, error) {
+	if len(text) > MaxLength {
+		return nil, Error{MaxLength + 1, "rule is longer than " + strconv.Itoa(MaxLength) + " characters"}
+	}
+	tokens, err := lex(text)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{tokens: tokens, fields: fields, maxWindow: maxWindow}
+	rule, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != "end" {
+		return nil, Error{tok.pos, "unexpected " + describe(tok)}
+	}
+	kind, err := rule.Check(false)
+	if err != nil {
+		return nil, err
+	}
+	if kind != KindBool {
+		return nil, Error{rule.Position(), "a rule must be a condition, not a " + kind.String()}
+	}
+	return rule, nil
+}
@@ -0,0 +1,112 @@
+package trigger
+
+import (
+	"strings"
+	"testing"
+)
+
+var testFields = map[string]Kind{"rain": KindNumber, "weather": KindString}
+
+func TestCompile(t *testing.T) {
+	days := series(1, 8, 3, 9, 7)
+	cases := []struct {
+		rule string
+		want bool
+	}{
+		{`consecutive(weather == "rainy") >= 2`, true},
+		{`consecutive(weather == "rainy", 5, 12h) >= 2`, false},
+		{`count(weather == "rainy", 3d) == 2 && !(max(rain) > 9)`, true},
+		{`mean(rain, 2) < 8 || sum(rain) > -1`, true},
+		{`min(rain, 10d) >= 1 && min(rain, 10d) <= 1`, true},
+		{`COUNT(Weather != "dry") == 3`, true},
+		{`true && false == false`, true},
+	}
+	for _, c := range cases {
+		t.Run(c.rule, func(t *testing.T) {
+			rule, err := Compile(c.rule, testFields, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			held, err := Evaluate(rule, days, 5*day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if held != c.want {
+				t.Fatalf("got %v, want %v", held, c.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := []struct {
+		rule     string
+		position int
+		message  string
+	}{
+		{`sum(rain) > 1 &&`, 17, "unexpected end of rule"},
+		{`sum(rain) > "a"`, 11, "Cannot compare a number with a string"},
+		{`sum(rain) >= 1 && max(rain)`, 19, "&& needs bools, not a number"},
+		{`count(rain) > 1`, 7, "count needs a bool, not a number"},
+		{`!sum(rain)`, 2, "! needs a bool, not a number"},
+		{`weather == "dry"`, 1, "Field weather can only be read inside an aggregate"},
+		{`"a" < "b"`, 5, "Only numbers can be ordered with <"},
+		{`max(sum(rain)) > 1`, 5, "Aggregates cannot be nested, sum is inside another"},
+		{`  sum(rain)`, 3, "a rule must be a condition, not a number"},
+		{`sum(rain, 11) > 1`, 11, "window must be between 1 and 10 readings"},
+		{`sum(rain, 11d) > 1`, 11, "duration must be a whole number of d, h or m up to 10d"},
+		{`sum(rain, 1d, 1d) > 1`, 15, "only consecutive takes a gap, as a duration"},
+		{`sum(wind) > 1`, 5, `unknown field "wind"`},
+		{`median(rain) > 1`, 1, `unknown aggregate "median"`},
+		{`sum(rain) > 1 # 2`, 15, `unexpected "#"`},
+		{`count(weather == "dry) > 1`, 18, "string is not closed"},
+		{`sum(rain) > -"a"`, 13, "- must be followed by a number"},
+		{`sum(rain) > 1 1`, 15, `unexpected "1"`},
+		{`sum(rain > 1`, 13, "expected ), found end of rule"},
+		{strings.Repeat("(", MaxDepth) + "true" + strings.Repeat(")", MaxDepth), MaxDepth + 1, "rule is nested too deeply"},
+		{strings.Repeat(" ", MaxLength+1), MaxLength + 1, "rule is longer than 512 characters"},
+	}
+	for _, c := range cases {
+		t.Run(c.rule, func(t *testing.T) {
+			_, err := Compile(c.rule, testFields, 10)
+			ruleErr, ok := err.(Error)
+			if !ok {
+				t.Fatalf("got error %v, want an Error", err)
+			}
+			if ruleErr.Position != c.position || ruleErr.Message != c.message {
+				t.Fatalf("got %d %q, want %d %q", ruleErr.Position, ruleErr.Message, c.position, c.message)
+			}
+		})
+	}
+}
+
+// FuzzCompileRule compiles arbitrary text. It must never panic, errors must point inside the text or just past it,
+// and every rule that compiles must evaluate over samples that have all the fields.
+func FuzzCompileRule(f *testing.F) {
+	for _, rule := range []string{
+		`consecutive(weather == "rainy", 4, 2d) >= 3 && min(rain, 3d) < 5`,
+		`!(count(weather != "dry", 5) > 2 || mean(rain) <= -1.5)`,
+		`sum(rain, 3) > "a"`,
+		`max(sum(rain))`,
+		`count(weather == "a\"b`,
+	} {
+		f.Add(rule)
+	}
+	days := series(1, 8, 3, 9, 7)
+	f.Fuzz(func(t *testing.T, text string) {
+		rule, err := Compile(text, testFields, 10)
+		if err != nil {
+			ruleErr, ok := err.(Error)
+			if !ok {
+				t.Fatalf("got error %v, want an Error", err)
+			}
+			if ruleErr.Position < 1 || ruleErr.Position > len(text)+1 {
+				t.Fatalf("error at column %d of a rule %d long", ruleErr.Position, len(text))
+			}
+			return
+		}
+		if _, err := Evaluate(rule, days, 5*day); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
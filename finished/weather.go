@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/tomssy/farmbot_arduOS_mod/finished/trigger"
+)
+
+var WeatherPrefix = "_weather/" //every reading lives at _weather/<farm>/<date>/<source> so a farm's history range-reads in date order
+var WeatherWindow = 7           //how many of the latest observed days the farm summary keeps
+var AdverseStreakTrigger = 3    //adverse days in a row that pay out a farm's policies
+var DateLayout = "2006-01-02"   //observation dates are plain calendar days
+var SeedSource = "create_farm"  //source recorded for the readings a farm is created with
+
+type WeatherSummary struct { //kept on the farm so triggers never have to scan the whole history
+	Count         int       `json:"count"`          // readings stored for the farm, every source counted
+	FirstDate     string    `json:"first_date"`     // oldest observation date
+	LastDate      string    `json:"last_date"`      // newest observation date
+	AdverseStreak int       `json:"adverse_streak"` // adverse days in a row, with no missing day, up to LastDate
+	Recent        []Weather `json:"recent"`         // one merged reading per day for the last WeatherWindow observed days, oldest first
+}
+
+// weatherKey is the ledger key of one source's reading for a farm on a date, dates sort the same way as time
+func weatherKey(farm string, date string, source string) string {
+	return historyKey(WeatherPrefix, farm, date, source)
+}
+
+// historyKey lays out weather keys for anything with a history, farms under WeatherPrefix and zones under ZoneWeatherPrefix
+func historyKey(prefix string, name string, date string, source string) string {
+	return prefix + name + "/" + date + "/" + source
+}
+
+// parseDate checks an observation date and returns the start of that day in ms since epoch
+func parseDate(date string) (int64, error) {
+	day, err := time.Parse(DateLayout, date)
+	if err != nil {
+		return 0, errors.New("Expecting a date like " + DateLayout + ", got " + date)
+	}
+	return day.UnixNano() / int64(time.Millisecond), nil
+}
+
+// getFarm reads a farm and fails if it was never created
+func getFarm(stub shim.ChaincodeStubInterface, name string) (Farm, error) {
+	var farm Farm
+	farmAsBytes, err := stub.GetState(name)
+	if err != nil {
+		return farm, errors.New("Failed to get farm " + name)
+	}
+	json.Unmarshal(farmAsBytes, &farm)
+	if farm.Name != name {
+		return farm, errors.New("farm not exist")
+	}
+	return farm, nil
+}
+
+// putFarm writes a farm and logs the new version in its history
+func putFarm(stub shim.ChaincodeStubInterface, farm Farm) error {
+	farmAsBytes, _ := json.Marshal(farm)
+	err := stub.PutState(farm.Name, farmAsBytes)
+	if err != nil {
+		return err
+	}
+	return recordVersion(stub, "farm", farm.Name, farmAsBytes)
+}
+
+// putWeather stores a reading under its own key and refreshes the farm's summary, the caller saves the farm.
+// A replay of a reading already on the ledger is merged away and reports stored == false.
+func putWeather(stub shim.ChaincodeStubInterface, farm *Farm, reading Weather) (bool, error) {
+	var err error
+	reading.Farm = farm.Name
+	reading.Observed, err = parseDate(reading.Date)
+	if err != nil {
+		return false, err
+	}
+	if len(reading.Source) <= 0 || strings.Contains(reading.Source, "/") {
+		return false, errors.New("Reading source must be a non-empty name without '/'")
+	}
+
+	stored, err := storeReading(stub, WeatherPrefix, farm.Name, reading)
+	if err != nil || !stored {
+		return false, err
+	}
+	return true, refreshSummary(stub, farm, reading)
+}
+
+// storeReading writes a reading under the history of name at prefix. A replay of a reading already on the ledger is
+// merged away and reports stored == false, a different reading for the same day and source is an error.
+func storeReading(stub shim.ChaincodeStubInterface, prefix string, name string, reading Weather) (bool, error) {
+	key := historyKey(prefix, name, reading.Date, reading.Source)
+	existingAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, errors.New("Failed to get weather " + key)
+	}
+	if existingAsBytes != nil {
+		var existing Weather
+		json.Unmarshal(existingAsBytes, &existing)
+		if existing.Name == reading.Name && existing.Temperature == reading.Temperature {
+			fmt.Println("! duplicate reading merged: " + key) //same report sent twice, keep the first one
+			return false, nil
+		}
+		return false, errors.New("A different reading already exists for " + key)
+	}
+
+	jsonAsBytes, _ := json.Marshal(reading)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// refreshSummary folds a newly stored reading into the farm summary. Readings may arrive out of order,
+// so the recent window is rebuilt from the ledger starting at whichever is older, the reading or the window.
+func refreshSummary(stub shim.ChaincodeStubInterface, farm *Farm, reading Weather) error {
+	summary := &farm.Summary
+	summary.Count++
+	if summary.FirstDate == "" || reading.Date < summary.FirstDate {
+		summary.FirstDate = reading.Date
+	}
+	if reading.Date > summary.LastDate {
+		summary.LastDate = reading.Date
+	}
+	if len(summary.Recent) >= WeatherWindow && reading.Date < summary.Recent[0].Date {
+		return nil //too old to change anything the triggers look at
+	}
+
+	from := reading.Date
+	if len(summary.Recent) > 0 && summary.Recent[0].Date < from {
+		from = summary.Recent[0].Date
+	}
+	readings, err := getWeatherRange(stub, WeatherPrefix, farm.Name, from, "")
+	if err != nil {
+		return err
+	}
+	days := mergeDays(readings)
+	if len(days) > WeatherWindow {
+		days = days[len(days)-WeatherWindow:]
+	}
+	summary.Recent = days
+	summary.AdverseStreak = adverseStreak(days)
+	return nil
+}
+
+// mergeDays collapses readings sorted by date into one reading per day. The day's condition is the one
+// most sources agree on, ties going to the source that sorts first, and its temperature is the sources' mean.
+func mergeDays(readings []Weather) []Weather {
+	var days []Weather
+	for start := 0; start < len(readings); {
+		end := start
+		votes := map[string]int{}
+		total := 0
+		for end < len(readings) && readings[end].Date == readings[start].Date {
+			votes[readings[end].Name]++
+			total += readings[end].Temperature
+			end++
+		}
+		day := readings[start]
+		day.Source = ""
+		for i := start; i < end; i++ {
+			if votes[readings[i].Name] > votes[day.Name] {
+				day.Name = readings[i].Name
+				day.Severity = readings[i].Severity
+			}
+		}
+		day.Temperature = total / (end - start)
+		days = append(days, day)
+		start = end
+	}
+	return days
+}
+
+// adverseStreak counts adverse days in a row at the end of days, a missing calendar day breaks the run
+func adverseStreak(days []Weather) int {
+	streak := 0
+	for i := len(days) - 1; i >= 0; i-- {
+		if days[i].Severity != Adverse {
+			break
+		}
+		if i < len(days)-1 && days[i+1].Observed-days[i].Observed != int64(24*time.Hour/time.Millisecond) {
+			break
+		}
+		streak++
+	}
+	return streak
+}
+
+// weatherSeries turns merged days into samples a trigger rule can be evaluated over
+func weatherSeries(days []Weather) []trigger.Sample {
+	series := make([]trigger.Sample, len(days))
+	for i, day := range days {
+		series[i] = trigger.Sample{
+			At:      day.Observed,
+			Numbers: map[string]float64{"temperature": float64(day.Temperature)},
+			Strings: map[string]string{"condition": day.Name, "severity": day.Severity},
+		}
+	}
+	return series
+}
+
+// streakRule is the trigger of a policy without a rule of its own, streak adverse days in a row
+func streakRule(streak int) trigger.Expr {
+	adverse := trigger.Compare{Op: "==", Left: trigger.Field{Name: "severity", Kind: trigger.KindString}, Right: trigger.StringLiteral(Adverse)}
+	run := trigger.Aggregate{Func: "consecutive", Arg: adverse, Step: int64(24 * time.Hour / time.Millisecond)}
+	return trigger.Compare{Op: ">=", Left: run, Right: trigger.NumberLiteral(float64(streak))}
+}
+
+// triggered evaluates a rule over a farm's recent days as of the latest one
+func triggered(rule trigger.Expr, days []Weather) (bool, error) {
+	if len(days) == 0 {
+		return false, nil
+	}
+	return trigger.Evaluate(rule, weatherSeries(days), days[len(days)-1].Observed)
+}
+
+// getWeatherRange returns the readings of a farm or zone dated from..to, both inclusive and either may be "", oldest first
+func getWeatherRange(stub shim.ChaincodeStubInterface, prefix string, name string, from string, to string) ([]Weather, error) {
+	iter, err := stub.RangeQueryState(historyKey(prefix, name, from, ""), historyKey(prefix, name, to+"~", ""))
+	if err != nil {
+		return nil, errors.New("Failed to range over weather of " + name)
+	}
+	defer iter.Close()
+
+	var readings []Weather
+	for iter.HasNext() {
+		_, valAsbytes, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var reading Weather
+		json.Unmarshal(valAsbytes, &reading)
+		readings = append(readings, reading)
+	}
+	return readings, nil
+}
+
+// ============================================================================================================================
+// Get Weather - read a farm's weather readings between two dates, or a zone's when a 4th argument of "zone" is given
+// ============================================================================================================================
+func (t *SimpleChaincode) get_weather(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1            2            3
+	//  'farm_name'  'from date'  'to date'   ['farm' | 'zone' | 'station']     dates are YYYY-MM-DD, both inclusive, either may be ""
+	if len(args) != 3 && len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 or 4")
+	}
+	if len(args[0]) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+	prefix := WeatherPrefix
+	if len(args) == 4 && strings.ToLower(args[3]) == "zone" {
+		prefix = ZoneWeatherPrefix
+	} else if len(args) == 4 && strings.ToLower(args[3]) == "station" {
+		prefix = StationWeatherPrefix
+	}
+	for _, date := range args[1:3] {
+		if len(date) > 0 {
+			if _, err := parseDate(date); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	readings, err := getWeatherRange(stub, prefix, strings.ToLower(args[0]), args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(readings)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var ZonePrefix = "_zone/"               //every zone lives at _zone/<name> and lists the farms in it
+var ZoneWeatherPrefix = "_zoneweather/" //a zone's own readings, laid out like WeatherPrefix
+var ZoneGridSize = 0.5                  //degrees per side of the grid cell a farm falls in when no named region is given
+
+type Zone struct {
+	Name    string   `json:"name"`    // grid_<lat cell>_<lon cell> or a named region
+	Farms   []string `json:"farms"`   // farms located in the zone
+	Defined bool     `json:"defined"` // a named region an admin defined, farms can only be placed in those or a grid cell
+}
+
+// gridZone names the grid cell that contains a coordinate
+func gridZone(latitude float64, longitude float64) string {
+	return fmt.Sprintf("grid_%d_%d", int(math.Floor(latitude/ZoneGridSize)), int(math.Floor(longitude/ZoneGridSize)))
+}
+
+func getZone(stub shim.ChaincodeStubInterface, name string) (Zone, error) {
+	zone := Zone{Name: name}
+	zoneAsBytes, err := stub.GetState(ZonePrefix + name)
+	if err != nil {
+		return zone, errors.New("Failed to get zone " + name)
+	}
+	json.Unmarshal(zoneAsBytes, &zone)
+	return zone, nil
+}
+
+// findZone reads a zone and fails if no farm was ever located in it
+func findZone(stub shim.ChaincodeStubInterface, name string) (Zone, error) {
+	var zone Zone
+	zoneAsBytes, err := stub.GetState(ZonePrefix + name)
+	if err != nil {
+		return zone, errors.New("Failed to get zone " + name)
+	}
+	json.Unmarshal(zoneAsBytes, &zone)
+	if zone.Name != name {
+		return zone, errors.New("zone not exist")
+	}
+	return zone, nil
+}
+
+func putZone(stub shim.ChaincodeStubInterface, zone Zone) error {
+	zoneAsBytes, _ := json.Marshal(zone)
+	return stub.PutState(ZonePrefix+zone.Name, zoneAsBytes)
+}
+
+// moveFarmZone takes a farm out of its old zone's member list and adds it to the new one
+func moveFarmZone(stub shim.ChaincodeStubInterface, farm string, from string, to string) error {
+	if from == to {
+		return nil
+	}
+	if from != "" {
+		old, err := getZone(stub, from)
+		if err != nil {
+			return err
+		}
+		var kept []string
+		for _, name := range old.Farms {
+			if name != farm {
+				kept = append(kept, name)
+			}
+		}
+		old.Farms = kept
+		err = putZone(stub, old)
+		if err != nil {
+			return err
+		}
+	}
+	zone, err := getZone(stub, to)
+	if err != nil {
+		return err
+	}
+	zone.Farms = append(zone.Farms, farm)
+	return putZone(stub, zone)
+}
+
+// ============================================================================================================================
+// Set Farm Location - place a farm at a coordinate and in a weather zone, farm owner only and not while the farm is insured
+// ============================================================================================================================
+func (t *SimpleChaincode) set_farm_location(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0            1           2            3
+	//  'farm_name'  'latitude'  'longitude'  'zone'     zone is a region defined with define_zone, or "" to use the grid cell of the coordinate
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	fmt.Println("- start set farm location")
+	latitude, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		return nil, errors.New("2nd argument must be a latitude between -90 and 90")
+	}
+	longitude, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		return nil, errors.New("3rd argument must be a longitude between -180 and 180")
+	}
+	zone := strings.ToLower(strings.TrimSpace(args[3]))
+	if zone == "" {
+		zone = gridZone(latitude, longitude)
+	} else if region, err := getZone(stub, zone); err != nil {
+		return nil, err
+	} else if !region.Defined {
+		return nil, errors.New("Zone " + zone + " is not a region an admin has defined")
+	}
+
+	farm, err := getFarm(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerName(stub)
+	if err != nil {
+		return nil, err
+	}
+	if farm.Owner != caller {
+		return nil, errors.New("Only the owner of " + farm.Name + " can move it")
+	}
+	err = requireUninsured(stub, farm.Name) //the insured must not pick whose weather triggers the cover
+	if err != nil {
+		return nil, err
+	}
+
+	err = moveFarmZone(stub, farm.Name, farm.Zone, zone)
+	if err != nil {
+		return nil, err
+	}
+	farm.Latitude = latitude
+	farm.Longitude = longitude
+	farm.Zone = zone
+	err = relinkStations(stub, &farm)
+	if err != nil {
+		return nil, err
+	}
+	err = putFarm(stub, farm)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end set farm location")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Define Zone - add a named region farms can be placed in, admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) define_zone(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	//  'zone'
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	fmt.Println("- start define zone")
+	if _, err := requireRole(stub, AdminRole); err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimSpace(args[0]))
+	if len(name) <= 0 || strings.Contains(name, "/") || strings.HasPrefix(name, "grid_") {
+		return nil, errors.New("1st argument must be a non-empty name without '/' that does not start with grid_")
+	}
+	zone, err := getZone(stub, name)
+	if err != nil {
+		return nil, err
+	}
+	zone.Defined = true
+	err = putZone(stub, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end define zone")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Update Weather Zone - record one observation for a whole zone and evaluate the triggers of every farm in it, oracles only
+// ============================================================================================================================
+func (t *SimpleChaincode) update_weather_zone(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1              2              3         4
+	//  'zone'   'weather type' 'Temperature'  'date'   'source'
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	fmt.Println("- start update weather zone")
+	if _, err := requireOracle(stub); err != nil {
+		return nil, err
+	}
+	for i, arg := range args {
+		if len(arg) <= 0 {
+			return nil, errors.New("Argument " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+	Temperature, err := strconv.Atoi(args[2])
+	if err != nil {
+		return nil, errors.New("is not a numeric string " + args[2])
+	}
+	if strings.ContainsAny(args[4], "/@") { //the source is part of the zone's key and, tagged with @zone, of every farm's
+		return nil, errors.New("5th argument must be a source name without '/' or '@'")
+	}
+	zone, err := findZone(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	reading := Weather{Name: args[1], Temperature: Temperature, Date: args[3], Source: strings.ToLower(args[4])}
+	reading.Observed, err = parseDate(reading.Date)
+	if err != nil {
+		return nil, err
+	}
+	reading.Recorded, err = txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	vocabulary, err := getVocabulary(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = normalizeWeather(vocabulary, &reading)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := storeReading(stub, ZoneWeatherPrefix, zone.Name, reading)
+	if err != nil || !stored {
+		return nil, err
+	}
+
+	//fan out to every farm in the zone, tagging the source so it never clashes with a farm's own feed
+	for _, name := range zone.Farms {
+		farm, err := getFarm(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		farmReading := reading
+		farmReading.Source = reading.Source + "@" + zone.Name
+		stored, err := putWeather(stub, &farm, farmReading)
+		if err != nil {
+			return nil, err
+		}
+		if !stored {
+			continue
+		}
+		err = putFarm(stub, farm)
+		if err != nil {
+			return nil, err
+		}
+		err = check_triggers(stub, farm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("- end update weather zone")
+	return nil, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSetFarmLocation(t *testing.T) {
+	cases := []struct {
+		name    string
+		defined bool
+		policy  string // state of a policy on the farm, "" for none
+		zone    string
+		wantErr string
+	}{
+		{name: "grid cell", zone: ""},
+		{name: "defined region", defined: true, zone: "valley"},
+		{name: "undefined region", zone: "valley", wantErr: "not a region"},
+		{name: "active policy", policy: "actived", zone: "", wantErr: "active insurance"},
+		{name: "pending policy", policy: "pending", zone: "", wantErr: "active insurance"},
+		{name: "solved policy", policy: "solved", zone: ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := newFakeStub(testNow)
+			rolesAsBytes, _ := json.Marshal(Roles{Members: map[string][]string{AdminRole: {"alice"}}})
+			stub.state[RolesStr] = rolesAsBytes
+			if err := putFarm(stub, Farm{Name: "farm1", Owner: "ben"}); err != nil {
+				t.Fatal(err)
+			}
+			if c.defined {
+				stub.caller = "alice"
+				if _, err := new(SimpleChaincode).Invoke(stub, "define_zone", []string{c.zone}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.policy != "" {
+				if err := putInsurances(stub, ActiveInsurance{AllInsurance: []AnInsurance{{ID: "p1", Insurant: "farm1", Number: 1, Rate: 1, State: c.policy}}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stub.caller = "ben"
+			_, err := new(SimpleChaincode).Invoke(stub, "set_farm_location", []string{"farm1", "10", "20", c.zone})
+			if c.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefineZoneAdminOnly(t *testing.T) {
+	stub := newFakeStub(testNow)
+	stub.caller = "ben"
+	if _, err := new(SimpleChaincode).Invoke(stub, "define_zone", []string{"valley"}); err == nil {
+		t.Fatal("a non-admin defined a zone")
+	}
+}
+
+func TestLinkStationInsured(t *testing.T) {
+	stub := newFakeStub(testNow)
+	addStation(t, stub, "station1", newEd25519Signer(t), "active")
+	farm, _ := getFarm(stub, "farm1")
+	farm.Zone = "grid_0_0"
+	if err := putFarm(stub, farm); err != nil {
+		t.Fatal(err)
+	}
+	if err := putInsurances(stub, ActiveInsurance{AllInsurance: []AnInsurance{{ID: "p1", Insurant: "farm1", Number: 1, Rate: 1, State: "actived"}}}); err != nil {
+		t.Fatal(err)
+	}
+	stub.caller = "owner1"
+	for _, call := range [][]string{{"link_station", "farm1", "station2", "10"}, {"unlink_station", "farm1", "station1"}} {
+		if _, err := new(SimpleChaincode).Invoke(stub, call[0], call[1:]); err == nil || !strings.Contains(err.Error(), "active insurance") {
+			t.Fatalf("%s: got error %v, want the insured farm refused", call[0], err)
+		}
+	}
+}